@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Why a request ended, see AccessRecord.Termination.
+const (
+	TermComplete        = "complete"          // response relayed or sent in full
+	TermDenied          = "denied"            // refused by auth, ACL, blocklist or address check
+	TermBadRequest      = "bad_request"       // invalid or unsupported request
+	TermRequestTimeout  = "request_timeout"   // client too slow
+	TermRequestTooLarge = "request_too_large" // request line or header over the limits
+	TermDialError       = "dial_error"
+	TermDialTimeout     = "dial_timeout"
+	TermUpstreamError   = "upstream_error"
+	TermUpstreamTimeout = "upstream_timeout"
+	TermClientClosed    = "client_closed"
+	TermUpstreamClosed  = "upstream_closed" // tunnel closed by the server side
+	TermCanceled        = "canceled"        // Worker.Cancel, e.g. on shutdown
+	TermConnLimit       = "conn_limit"
+	TermReplayMiss      = "replay_miss" // no recorded response, see -replay
+	TermCacheMiss       = "cache_miss"  // only-if-cached request not in the cache
+)
+
+// AccessRecord describes one completed request.
+type AccessRecord struct {
+	ID          uint64    // request ID as in diagnostic logs, zero if no request was read
+	Time        time.Time // when the request was received
+	Client      string    // client address
+	User        string    // authenticated user, empty if none
+	Method      string
+	URI         string
+	Version     string
+	Upstream    string // address connected to, empty if none
+	Status      int    // 0 if no response was sent
+	BytesIn     int64  // body bytes received from the client
+	BytesOut    int64  // body bytes sent to the client
+	Referer     string
+	UserAgent   string
+	Termination string
+
+	// Timing breakdown. Phases that didn't happen are zero.
+	Header    time.Duration // from accepting the connection to the end of the request header
+	Dial      time.Duration
+	FirstByte time.Duration // from sending the request to the response header
+	Transfer  time.Duration // from the response header to the end
+	Total     time.Duration // from accepting the connection to the end
+}
+
+type AccessLogFormat string
+
+const (
+	AccessLogCommon   AccessLogFormat = "common"
+	AccessLogCombined AccessLogFormat = "combined"
+	AccessLogJSON     AccessLogFormat = "json"
+)
+
+func parseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch f := AccessLogFormat(s); f {
+	case AccessLogCommon, AccessLogCombined, AccessLogJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("Unknown access log format: %s", s)
+}
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// clfQuote escapes |s| for a quoted Common Log Format field.
+func clfQuote(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(clfQuote(s), " ", "\\x20")
+}
+
+func (r *AccessRecord) common() string {
+	request := "-"
+	if r.Method != "" {
+		request = r.Method + " " + r.URI + " " + r.Version
+	}
+	status, bytes := "-", "-"
+	if r.Status != 0 {
+		status = strconv.Itoa(r.Status)
+	}
+	if r.BytesOut > 0 {
+		bytes = strconv.FormatInt(r.BytesOut, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s\" %s %s",
+		clfField(r.Client), clfField(r.User), r.Time.Format(clfTimeFormat),
+		clfQuote(request), status, bytes)
+}
+
+func (r *AccessRecord) combined() string {
+	referer, agent := "-", "-"
+	if r.Referer != "" {
+		referer = clfQuote(r.Referer)
+	}
+	if r.UserAgent != "" {
+		agent = clfQuote(r.UserAgent)
+	}
+	return fmt.Sprintf("%s \"%s\" \"%s\"", r.common(), referer, agent)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (r *AccessRecord) json() string {
+	b, _ := json.Marshal(struct {
+		ID          uint64             `json:"request_id,omitempty"`
+		Time        string             `json:"time"`
+		Client      string             `json:"client"`
+		User        string             `json:"user,omitempty"`
+		Method      string             `json:"method,omitempty"`
+		URI         string             `json:"uri,omitempty"`
+		Version     string             `json:"version,omitempty"`
+		Upstream    string             `json:"upstream,omitempty"`
+		Status      int                `json:"status,omitempty"`
+		BytesIn     int64              `json:"bytes_in"`
+		BytesOut    int64              `json:"bytes_out"`
+		Referer     string             `json:"referer,omitempty"`
+		UserAgent   string             `json:"user_agent,omitempty"`
+		Termination string             `json:"termination"`
+		Timing      map[string]float64 `json:"timing_ms"`
+	}{
+		r.ID, r.Time.Format(time.RFC3339Nano), r.Client, r.User,
+		r.Method, r.URI, r.Version, r.Upstream, r.Status,
+		r.BytesIn, r.BytesOut, r.Referer, r.UserAgent, r.Termination,
+		map[string]float64{
+			"header":     milliseconds(r.Header),
+			"dial":       milliseconds(r.Dial),
+			"first_byte": milliseconds(r.FirstByte),
+			"transfer":   milliseconds(r.Transfer),
+			"total":      milliseconds(r.Total),
+		},
+	})
+	return string(b)
+}
+
+// Format returns the record as a single line without newline.
+func (r *AccessRecord) Format(f AccessLogFormat) string {
+	switch f {
+	case AccessLogCommon:
+		return r.common()
+	case AccessLogJSON:
+		return r.json()
+	}
+	return r.combined()
+}
+
+// AccessLog writes one line per request. It is disabled until opened.
+type AccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer // nil for stdout and stderr
+	format AccessLogFormat
+}
+
+// Shared by all workers.
+var accessLog = &AccessLog{}
+
+// Open starts writing to |output|, "stdout", "stderr" or a file to append
+// to, and closes the previous file. An empty |output| disables the log.
+func (l *AccessLog) Open(output string, format AccessLogFormat) error {
+	w, closer, err := openAccessLogOutput(output)
+	if err != nil {
+		return err
+	}
+	l.set(w, closer, format)
+	return nil
+}
+
+func openAccessLogOutput(output string) (io.Writer, io.Closer, error) {
+	if output == "" {
+		return nil, nil, nil
+	}
+	return openLogOutput(output)
+}
+
+func (l *AccessLog) set(w io.Writer, closer io.Closer, format AccessLogFormat) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closer != nil {
+		l.closer.Close()
+	}
+	l.w, l.closer, l.format = w, closer, format
+}
+
+func (l *AccessLog) Write(r *AccessRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w == nil {
+		return
+	}
+	if _, err := io.WriteString(l.w, r.Format(l.format)+"\n"); err != nil {
+		logger.Errorf("access log: %v", err)
+	}
+}
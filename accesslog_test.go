@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testAccessRecord() *AccessRecord {
+	return &AccessRecord{
+		Time:        time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		Client:      "10.0.0.5:51234",
+		User:        "alice",
+		Method:      "GET",
+		URI:         "http://example.com/a\"b",
+		Version:     "HTTP/1.1",
+		Upstream:    "93.184.216.34:80",
+		Status:      200,
+		BytesOut:    1234,
+		UserAgent:   "curl/8.0",
+		Termination: TermComplete,
+		Dial:        1500 * time.Microsecond,
+		Total:       20 * time.Millisecond,
+	}
+}
+
+func TestAccessRecordFormat(t *testing.T) {
+	r := testAccessRecord()
+	ExpectEqual(t,
+		`10.0.0.5:51234 - alice [01/Mar/2024:12:30:00 +0000] "GET http://example.com/a\"b HTTP/1.1" 200 1234`,
+		r.Format(AccessLogCommon))
+	ExpectEqual(t,
+		`10.0.0.5:51234 - alice [01/Mar/2024:12:30:00 +0000] "GET http://example.com/a\"b HTTP/1.1" 200 1234 "-" "curl/8.0"`,
+		r.Format(AccessLogCombined))
+
+	var m map[string]any
+	if err := json.Unmarshal([]byte(r.Format(AccessLogJSON)), &m); err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "93.184.216.34:80", m["upstream"].(string))
+	ExpectEqual(t, "complete", m["termination"].(string))
+	ExpectEqual(t, "map[dial:1.5 first_byte:0 header:0 total:20 transfer:0]", fmt.Sprint(m["timing_ms"]))
+
+	r = &AccessRecord{Time: r.Time, Client: "10.0.0.5:1", Status: 503}
+	ExpectEqual(t, `10.0.0.5:1 - - [01/Mar/2024:12:30:00 +0000] "-" 503 -`, r.Format(AccessLogCommon))
+}
+
+func captureAccessLog(format AccessLogFormat) (*bytes.Buffer, func()) {
+	b := &bytes.Buffer{}
+	accessLog.set(b, nil, format)
+	return b, func() { accessLog.set(nil, nil, "") }
+}
+
+func TestWorkerAccessLog(t *testing.T) {
+	b, restore := captureAccessLog(AccessLogJSON)
+	defer restore()
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, c)
+		go io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nFooBar")
+		return s, nil
+	}
+	client, finished := runWorkerOnPipe(Timeouts{})
+	client.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\n" +
+		"Content-Length: 5\r\nUser-Agent: test\r\n\r\nhello"))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	io.ReadAll(client)
+	<-finished
+
+	var m map[string]any
+	if err := json.Unmarshal(b.Bytes(), &m); err != nil {
+		t.Fatalf("%v: %q", err, b.String())
+	}
+	ExpectEqual(t, "POST /upload 200 5 6 complete test", fmt.Sprint(
+		m["method"], " ", m["uri"], " ", m["status"], " ", m["bytes_in"], " ",
+		m["bytes_out"], " ", m["termination"], " ", m["user_agent"]))
+	ExpectEqual(t, "pipe", m["upstream"].(string))
+}
+
+func TestWorkerAccessLogDenied(t *testing.T) {
+	b, restore := captureAccessLog(AccessLogCommon)
+	defer restore()
+	saved := accessControl
+	defer func() { accessControl = saved }()
+	accessControl = &ACL{Default: ACLDeny}
+
+	client, finished := runWorkerOnPipe(Timeouts{})
+	client.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	readStatusLineWithin(t, client, time.Second)
+	<-finished
+
+	ExpectEqual(t, `"GET http://example.com/ HTTP/1.1" 403 -`+"\n",
+		b.String()[bytes.IndexByte(b.Bytes(), '"'):])
+}
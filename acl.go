@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type ACLAction int
+
+const (
+	ACLAllow ACLAction = iota
+	ACLDeny
+)
+
+func (a ACLAction) String() string {
+	if a == ACLDeny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// ACLRule matches a request if every non-empty condition matches. Within
+// a condition any of the listed values may match.
+type ACLRule struct {
+	Name    string // used in logs
+	Action  ACLAction
+	Clients []*net.IPNet
+	Users   []string // authenticated user names
+	Groups  []string // groups of the authenticated user
+	// "example.com" matches exactly, ".example.com" matches the domain and
+	// its subdomains, and "*" in a pattern matches within a single label,
+	// so "*.example.com" matches "www.example.com" only.
+	Hosts   []string
+	Ports   []int
+	Methods []string
+}
+
+// ACL is an ordered list of rules. The first matching rule wins.
+type ACL struct {
+	Rules   []ACLRule
+	Default ACLAction
+}
+
+// aclRequest holds what rules can match on.
+type aclRequest struct {
+	client net.IP
+	user   string
+	groups []string
+	host   string
+	port   int
+	method string
+}
+
+func matchHostPattern(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, ".") {
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	}
+	if !strings.Contains(pattern, "*") {
+		return host == pattern
+	}
+	pls := strings.Split(pattern, ".")
+	hls := strings.Split(host, ".")
+	if len(pls) != len(hls) {
+		return false
+	}
+	for i, pl := range pls {
+		if ok, err := path.Match(pl, hls[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *ACLRule) matches(req aclRequest) bool {
+	if len(r.Clients) > 0 {
+		ok := false
+		for _, n := range r.Clients {
+			if req.client != nil && n.Contains(req.client) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.Users) > 0 {
+		ok := false
+		for _, u := range r.Users {
+			if u == req.user {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.Groups) > 0 {
+		id := Identity{req.user, req.groups}
+		ok := false
+		for _, g := range r.Groups {
+			if id.inGroup(g) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.Hosts) > 0 {
+		ok := false
+		for _, h := range r.Hosts {
+			if matchHostPattern(h, req.host) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.Ports) > 0 {
+		ok := false
+		for _, p := range r.Ports {
+			if p == req.port {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.Methods) > 0 {
+		ok := false
+		for _, m := range r.Methods {
+			if strings.EqualFold(m, req.method) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Check returns the action for |req| and the name of the rule that
+// decided it, or "default".
+func (a *ACL) Check(req aclRequest) (ACLAction, string) {
+	if a == nil {
+		return ACLAllow, "default"
+	}
+	for i := range a.Rules {
+		if a.Rules[i].matches(req) {
+			return a.Rules[i].Action, a.Rules[i].Name
+		}
+	}
+	return a.Default, "default"
+}
+
+// ParseACLRule parses a rule such as
+//
+//	deny client=10.0.0.0/8 user=bob group=ci host=.internal,*.corp.example.com port=22,8080 method=POST
+//
+// The action comes first and conditions are space separated.
+func ParseACLRule(name, s string) (ACLRule, error) {
+	r := ACLRule{Name: name}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return r, fmt.Errorf("Empty ACL rule")
+	}
+	switch fields[0] {
+	case "allow":
+		r.Action = ACLAllow
+	case "deny":
+		r.Action = ACLDeny
+	default:
+		return r, fmt.Errorf("Invalid ACL action: %s", fields[0])
+	}
+	for _, f := range fields[1:] {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok || value == "" {
+			return r, fmt.Errorf("Invalid ACL condition: %s", f)
+		}
+		values := strings.Split(value, ",")
+		switch key {
+		case "client":
+			for _, v := range values {
+				n, err := parseCIDR(v)
+				if err != nil {
+					return r, err
+				}
+				r.Clients = append(r.Clients, n)
+			}
+		case "user":
+			r.Users = append(r.Users, values...)
+		case "group":
+			r.Groups = append(r.Groups, values...)
+		case "host":
+			r.Hosts = append(r.Hosts, values...)
+		case "port":
+			for _, v := range values {
+				p, err := strconv.Atoi(v)
+				if err != nil || p <= 0 || p > 65535 {
+					return r, fmt.Errorf("Invalid port: %s", v)
+				}
+				r.Ports = append(r.Ports, p)
+			}
+		case "method":
+			r.Methods = append(r.Methods, values...)
+		default:
+			return r, fmt.Errorf("Unknown ACL condition: %s", key)
+		}
+	}
+	return r, nil
+}
+
+// parseCIDR also accepts a bare IP address as a single host network.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid address: %s", s)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid network: %s", s)
+	}
+	return n, nil
+}
+
+// Used by workers created from now on. Can be extended by flags.
+var accessControl = &ACL{}
+
+// aclFlag appends a rule to acl for each -acl flag.
+type aclFlag struct {
+	acl *ACL
+}
+
+func (aclFlag) String() string {
+	return ""
+}
+
+func (f aclFlag) Set(s string) error {
+	name := fmt.Sprintf("acl#%d", len(f.acl.Rules)+1)
+	r, err := ParseACLRule(name, s)
+	if err != nil {
+		return err
+	}
+	f.acl.Rules = append(f.acl.Rules, r)
+	return nil
+}
+
+// aclDefaultFlag sets the action taken when no rule matches.
+type aclDefaultFlag struct {
+	acl *ACL
+}
+
+func (aclDefaultFlag) String() string {
+	return "allow"
+}
+
+func (f aclDefaultFlag) Set(s string) error {
+	switch s {
+	case "allow":
+		f.acl.Default = ACLAllow
+	case "deny":
+		f.acl.Default = ACLDeny
+	default:
+		return fmt.Errorf("Invalid ACL action: %s", s)
+	}
+	return nil
+}
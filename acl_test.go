@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMatchHostPattern(t *testing.T) {
+	cases := []struct {
+		pattern, host string
+		expect        bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{"example.com", "www.example.com", false},
+		{".example.com", "example.com", true},
+		{".example.com", "a.b.example.com", true},
+		{".example.com", "badexample.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", "example.com", false},
+		{"api-*.example.com", "api-v2.example.com", true},
+		{"*", "anything", true},
+	}
+	for _, c := range cases {
+		if got := matchHostPattern(c.pattern, c.host); got != c.expect {
+			t.Errorf("matchHostPattern(%q, %q) = %v", c.pattern, c.host, got)
+		}
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	rules := []string{
+		"allow client=10.1.0.0/16 host=.internal",
+		"deny host=.internal,169.254.169.254",
+		"deny port=22,25",
+		"deny client=192.168.0.5 method=POST",
+		"deny user=mallory,eve",
+		"deny group=contractors host=.corp.example.com",
+	}
+	acl := &ACL{}
+	for i, s := range rules {
+		r, err := ParseACLRule(string(rune('a'+i)), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acl.Rules = append(acl.Rules, r)
+	}
+
+	cases := []struct {
+		req    aclRequest
+		action ACLAction
+		rule   string
+	}{
+		{aclRequest{net.ParseIP("10.1.2.3"), "", nil, "db.internal", 80, "GET"}, ACLAllow, "a"},
+		{aclRequest{net.ParseIP("10.2.2.3"), "", nil, "db.internal", 80, "GET"}, ACLDeny, "b"},
+		{aclRequest{net.ParseIP("10.2.2.3"), "", nil, "169.254.169.254", 80, "GET"}, ACLDeny, "b"},
+		{aclRequest{net.ParseIP("10.2.2.3"), "", nil, "example.com", 22, "CONNECT"}, ACLDeny, "c"},
+		{aclRequest{net.ParseIP("192.168.0.5"), "", nil, "example.com", 80, "post"}, ACLDeny, "d"},
+		{aclRequest{net.ParseIP("192.168.0.5"), "", nil, "example.com", 80, "GET"}, ACLAllow, "default"},
+		{aclRequest{net.ParseIP("192.168.0.6"), "eve", nil, "example.com", 80, "GET"}, ACLDeny, "e"},
+		{aclRequest{net.ParseIP("192.168.0.6"), "bob", []string{"dev", "contractors"}, "git.corp.example.com", 443, "CONNECT"}, ACLDeny, "f"},
+		{aclRequest{net.ParseIP("192.168.0.6"), "bob", []string{"dev"}, "git.corp.example.com", 443, "CONNECT"}, ACLAllow, "default"},
+	}
+	for _, c := range cases {
+		action, rule := acl.Check(c.req)
+		if action != c.action || rule != c.rule {
+			t.Errorf("%v: got %v by %s, want %v by %s", c.req, action, rule, c.action, c.rule)
+		}
+	}
+
+	acl.Default = ACLDeny
+	if action, _ := acl.Check(cases[5].req); action != ACLDeny {
+		t.Errorf("default action not applied")
+	}
+}
+
+func TestParseACLRuleErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"permit host=example.com",
+		"deny host",
+		"deny port=http",
+		"deny port=70000",
+		"deny client=10.0.0.0/33",
+		"deny user=",
+	} {
+		if _, err := ParseACLRule("x", s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestWorkerACLDenied(t *testing.T) {
+	saved := accessControl
+	defer func() { accessControl = saved }()
+	r, _ := ParseACLRule("no-ssh", "deny port=22")
+	accessControl = &ACL{Rules: []ACLRule{r}}
+
+	dialed := false
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		dialed = true
+		return nil, io.EOF
+	}
+	client, finished := runWorkerOnPipe(Timeouts{})
+	client.Write([]byte("CONNECT example.com:22 HTTP/1.1\r\nHost: example.com:22\r\n\r\n"))
+
+	ExpectEqual(t, "HTTP/1.1 403 Forbidden", readStatusLineWithin(t, client, time.Second))
+	<-finished
+	if dialed {
+		t.Errorf("denied request should not dial")
+	}
+}
+
+func TestWorkerConnectTunnel(t *testing.T) {
+	var dialedAddr string
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		dialedAddr = addr
+		s, c := net.Pipe()
+		go func() {
+			// echo back 4 bytes then close
+			b := make([]byte, 4)
+			io.ReadFull(c, b)
+			c.Write(b)
+			c.Close()
+		}()
+		return s, nil
+	}
+	client, finished := runWorkerOnPipe(Timeouts{})
+	client.Write([]byte("CONNECT example.com HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	go client.Write([]byte("ping"))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	b, _ := io.ReadAll(client)
+	ExpectEqual(t, "HTTP/1.1 200 Connection Established\r\n\r\nping", string(b))
+	<-finished
+	ExpectEqual(t, "example.com:443", dialedAddr)
+}
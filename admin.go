@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// adminAPI serves the admin endpoints:
+//
+//	GET  /workers              running workers
+//	POST /workers/{id}/cancel  cancel a worker
+//	GET  /conn-limits          how often connection limits triggered
+//	GET  /log-level            current log level
+//	PUT  /log-level            set the log level, body {"level": "debug"}
+//	POST /config/reload        reload the -config file
+//	GET  /har                  state of -har recording
+//	PUT  /har                  pause or resume recording, body {"enabled": false}
+//
+// Every request must carry "Authorization: Bearer <token>".
+type adminAPI struct {
+	srv    *Server
+	token  string
+	reload func() error // nil without a configuration file
+}
+
+func NewAdminAPI(srv *Server, token string, reload func() error) http.Handler {
+	return &adminAPI{srv: srv, token: token, reload: reload}
+}
+
+// route returns the handlers of the endpoint at |path| by method, nil if
+// there is none. Routing is done by hand as ServeMux patterns with methods
+// and wildcards need Go 1.22 module semantics.
+func (a *adminAPI) route(path string) map[string]http.HandlerFunc {
+	switch path {
+	case "/workers":
+		return map[string]http.HandlerFunc{"GET": a.listWorkers}
+	case "/conn-limits":
+		return map[string]http.HandlerFunc{"GET": a.connLimitStats}
+	case "/log-level":
+		return map[string]http.HandlerFunc{"GET": a.getLogLevel, "PUT": a.setLogLevel}
+	case "/config/reload":
+		return map[string]http.HandlerFunc{"POST": a.reloadConfig}
+	case "/har":
+		return map[string]http.HandlerFunc{"GET": a.getHAR, "PUT": a.setHAR}
+	}
+	if rest, ok := strings.CutPrefix(path, "/workers/"); ok {
+		if id, ok := strings.CutSuffix(rest, "/cancel"); ok && id != "" && !strings.Contains(id, "/") {
+			return map[string]http.HandlerFunc{"POST": func(w http.ResponseWriter, r *http.Request) {
+				a.cancelWorker(w, r, id)
+			}}
+		}
+	}
+	return nil
+}
+
+func (a *adminAPI) authorized(r *http.Request) bool {
+	scheme, token := splitAuthorization(r.Header.Get("Authorization"))
+	return a.token != "" && strings.EqualFold(scheme, "Bearer") &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		logger.Warnf("admin: unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeJSONError(w, http.StatusUnauthorized, "Missing or wrong token")
+		return
+	}
+	logger.Infof("admin: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	handlers := a.route(r.URL.Path)
+	if handlers == nil {
+		writeJSONError(w, http.StatusNotFound, "No endpoint "+r.URL.Path)
+		return
+	}
+	h, ok := handlers[r.Method]
+	if !ok {
+		var allow []string
+		for m := range handlers {
+			allow = append(allow, m)
+		}
+		sort.Strings(allow)
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		writeJSONError(w, http.StatusMethodNotAllowed, r.Method+" not allowed")
+		return
+	}
+	h(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (a *adminAPI) listWorkers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.srv.Workers())
+}
+
+func (a *adminAPI) cancelWorker(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid worker ID")
+		return
+	}
+	if !a.srv.CancelWorker(id) {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("No worker %d", id))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+func (a *adminAPI) connLimitStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.srv.limiter.stats())
+}
+
+func (a *adminAPI) getLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logLevelBody{currentLogLevel().String()})
+}
+
+func (a *adminAPI) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var body logLevelBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	l, err := parseLogLevel(body.Level)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	SetLogLevel(l)
+	logger.Warnf("admin: log level set to %v", l)
+	writeJSON(w, http.StatusOK, logLevelBody{l.String()})
+}
+
+func (a *adminAPI) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if a.reload == nil {
+		writeJSONError(w, http.StatusNotFound, "No configuration file")
+		return
+	}
+	if err := a.reload(); err != nil {
+		logger.Errorf("config: reload failed, keeping previous: %v", err)
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+type harState struct {
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path,omitempty"`
+	Entries int    `json:"entries"`
+}
+
+func writeHARState(w http.ResponseWriter, h *HARRecorder) {
+	writeJSON(w, http.StatusOK, harState{h.Enabled(), h.path, h.Entries()})
+}
+
+func (a *adminAPI) getHAR(w http.ResponseWriter, r *http.Request) {
+	if harRecorder == nil {
+		writeJSONError(w, http.StatusNotFound, "Not recording, see -har")
+		return
+	}
+	writeHARState(w, harRecorder)
+}
+
+func (a *adminAPI) setHAR(w http.ResponseWriter, r *http.Request) {
+	if harRecorder == nil {
+		writeJSONError(w, http.StatusNotFound, "Not recording, see -har")
+		return
+	}
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+		writeJSONError(w, http.StatusBadRequest, `Expected {"enabled": true|false}`)
+		return
+	}
+	harRecorder.SetEnabled(*body.Enabled)
+	logger.Warnf("admin: HAR recording enabled: %v", *body.Enabled)
+	writeHARState(w, harRecorder)
+}
+
+// readAdminToken reads the token from the first line of |path|.
+func readAdminToken(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token, _, _ := strings.Cut(string(b), "\n")
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("%s: Empty admin token", path)
+	}
+	return token, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func adminRequest(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	h := NewAdminAPI(NewServer(), "secret", nil)
+	for _, token := range []string{"", "wrong"} {
+		w := adminRequest(h, "GET", "/workers", token, "")
+		ExpectEqual(t, "401", fmt.Sprint(w.Code))
+		ExpectEqual(t, `Bearer realm="admin"`, w.Header().Get("WWW-Authenticate"))
+	}
+	// An empty token never authorizes.
+	h = NewAdminAPI(NewServer(), "", nil)
+	r := httptest.NewRequest("GET", "/workers", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	ExpectEqual(t, "401", fmt.Sprint(w.Code))
+}
+
+func TestAdminWorkers(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	srv, ln, served := startTestServer(t)
+	defer func() {
+		ln.Close()
+		<-served
+	}()
+	h := NewAdminAPI(srv, "secret", nil)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitForWorkers(srv, 1)
+
+	w := adminRequest(h, "GET", "/workers", "secret", "")
+	ExpectEqual(t, "200", fmt.Sprint(w.Code))
+	var workers []WorkerInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &workers); err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "1", fmt.Sprint(len(workers)))
+	ExpectEqual(t, conn.LocalAddr().String(), workers[0].Client)
+
+	w = adminRequest(h, "POST", "/workers/x/cancel", "secret", "")
+	ExpectEqual(t, "400", fmt.Sprint(w.Code))
+	w = adminRequest(h, "POST", fmt.Sprintf("/workers/%d/cancel", workers[0].ID+1000), "secret", "")
+	ExpectEqual(t, "404", fmt.Sprint(w.Code))
+	w = adminRequest(h, "POST", fmt.Sprintf("/workers/%d/cancel", workers[0].ID), "secret", "")
+	ExpectEqual(t, "204", fmt.Sprint(w.Code))
+	io.ReadAll(conn)
+	waitForWorkers(srv, 0)
+	ExpectEqual(t, "0", fmt.Sprint(len(srv.Workers())))
+}
+
+func TestAdminConnLimits(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	srv := NewServer()
+	srv.limiter = newConnLimiter(ConnLimits{MaxPerClient: 1})
+	srv.limiter.acquire("a")
+	srv.limiter.acquire("a")
+	w := adminRequest(NewAdminAPI(srv, "secret", nil), "GET", "/conn-limits", "secret", "")
+	ExpectEqual(t, `{"total_limit_hits":0,"client_limit_hits":1,"queued":0,"rejected":1}`+"\n",
+		w.Body.String())
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	_, restore := captureLog(LevelInfo)
+	defer restore()
+	h := NewAdminAPI(NewServer(), "secret", nil)
+
+	w := adminRequest(h, "GET", "/log-level", "secret", "")
+	ExpectEqual(t, "{\"level\":\"info\"}\n", w.Body.String())
+	w = adminRequest(h, "DELETE", "/log-level", "secret", "")
+	ExpectEqual(t, "405 GET, PUT", fmt.Sprint(w.Code, " ", w.Header().Get("Allow")))
+	w = adminRequest(h, "GET", "/log-levels", "secret", "")
+	ExpectEqual(t, "404", fmt.Sprint(w.Code))
+	w = adminRequest(h, "PUT", "/log-level", "secret", `{"level": "verbose"}`)
+	ExpectEqual(t, "400", fmt.Sprint(w.Code))
+	w = adminRequest(h, "PUT", "/log-level", "secret", `{"level": "debug"}`)
+	ExpectEqual(t, "200", fmt.Sprint(w.Code))
+	ExpectEqual(t, "debug", currentLogLevel().String())
+}
+
+func TestAdminReload(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	w := adminRequest(NewAdminAPI(NewServer(), "secret", nil), "POST", "/config/reload", "secret", "")
+	ExpectEqual(t, "404", fmt.Sprint(w.Code))
+
+	var err error
+	h := NewAdminAPI(NewServer(), "secret", func() error { return err })
+	w = adminRequest(h, "POST", "/config/reload", "secret", "")
+	ExpectEqual(t, "{\"status\":\"reloaded\"}\n", w.Body.String())
+	err = fmt.Errorf("Invalid duration")
+	w = adminRequest(h, "POST", "/config/reload", "secret", "")
+	ExpectEqual(t, "422", fmt.Sprint(w.Code))
+	ExpectEqual(t, "{\"error\":\"Invalid duration\"}\n", w.Body.String())
+}
+
+func TestReadAdminToken(t *testing.T) {
+	token, err := readAdminToken(writeTempFile(t, "token", "  secret \nignored\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "secret", token)
+	if _, err := readAdminToken(writeTempFile(t, "empty", "\n")); err == nil {
+		t.Errorf("expected error for empty token")
+	}
+}
+
+func TestAdminHAR(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	a := NewAdminAPI(NewServer(), "secret", nil)
+	w := adminRequest(a, "GET", "/har", "secret", "")
+	ExpectEqual(t, "404", fmt.Sprint(w.Code))
+
+	h, err := OpenHARRecorder(filepath.Join(t.TempDir(), "out.har"), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	harRecorder = h
+	defer func() { harRecorder = nil }()
+
+	w = adminRequest(a, "PUT", "/har", "secret", `{}`)
+	ExpectEqual(t, "400", fmt.Sprint(w.Code))
+	w = adminRequest(a, "PUT", "/har", "secret", `{"enabled": false}`)
+	ExpectEqual(t, "200", fmt.Sprint(w.Code))
+	if h.Enabled() {
+		t.Errorf("recording not paused")
+	}
+	w = adminRequest(a, "GET", "/har", "secret", "")
+	ExpectEqual(t, `{"enabled":false,"path":"`+h.path+`","entries":0}`+"\n", w.Body.String())
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoCredentials      = errors.New("No credentials")
+	ErrInvalidCredentials = errors.New("Invalid credentials")
+)
+
+// Identity is who a request was authenticated as.
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+func (id Identity) inGroup(g string) bool {
+	for _, group := range id.Groups {
+		if group == g {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator checks the Proxy-Authorization header of a request.
+type Authenticator interface {
+	// Authenticate returns the identity for |authorization|, the value of
+	// Proxy-Authorization, which may be empty. ErrNoCredentials means that
+	// the header does not carry credentials this authenticator handles.
+	Authenticate(authorization string) (Identity, error)
+	// Challenge returns the value of Proxy-Authenticate sent with 407.
+	Challenge() string
+}
+
+// multiAuthenticator accepts credentials of any of its authenticators.
+type multiAuthenticator []Authenticator
+
+func (m multiAuthenticator) Authenticate(authorization string) (Identity, error) {
+	for _, a := range m {
+		id, err := a.Authenticate(authorization)
+		if err != ErrNoCredentials {
+			return id, err
+		}
+	}
+	return Identity{}, ErrNoCredentials
+}
+
+func (m multiAuthenticator) Challenge() string {
+	cs := make([]string, len(m))
+	for i, a := range m {
+		cs[i] = a.Challenge()
+	}
+	return strings.Join(cs, ", ")
+}
+
+// Used by workers created from now on. nil disables authentication.
+var proxyAuth Authenticator
+
+var authRealm = "proxy"
+
+func proxyAuthRequiredResponse(challenge string) *Response {
+	return &Response{
+		Version: "HTTP/1.1",
+		Status:  407,
+		Phrase:  "Proxy Authentication Required",
+		Headers: HTTPHeader{
+			"proxy-authenticate": challenge,
+			"content-length":     "0",
+		},
+	}
+}
+
+// splitAuthorization splits "Scheme params" of an Authorization header.
+func splitAuthorization(authorization string) (string, string) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(authorization), " ")
+	return scheme, strings.TrimSpace(params)
+}
+
+// watchedFile tells whether a file changed since it was last loaded.
+type watchedFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// changed stats the file and reports whether its size or modification
+// time differ from the last call to loaded.
+func (f *watchedFile) changed() (bool, error) {
+	st, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	return !st.ModTime().Equal(f.modTime) || st.Size() != f.size, nil
+}
+
+func (f *watchedFile) loaded() error {
+	st, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.modTime = st.ModTime()
+	f.size = st.Size()
+	return nil
+}
+
+// pollFiles calls |reload| whenever any of |files| changes, checking
+// every |interval| until |done| is closed. |reload| is expected to keep
+// the previous state if it fails.
+func pollFiles(files []*watchedFile, interval time.Duration, done <-chan struct{},
+	reload func() error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+		var changed []string
+		for _, f := range files {
+			if c, err := f.changed(); err != nil {
+				logger.Errorf("%v", err)
+			} else if c {
+				changed = append(changed, f.path)
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		if err := reload(); err != nil {
+			logger.Errorf("reloading %v failed, keeping previous: %v", changed, err)
+			continue
+		}
+		logger.Infof("reloaded %v", changed)
+	}
+}
+
+// htpasswdFile holds bcrypt hashed passwords loaded from an htpasswd file
+// and reloads it when it changes.
+type htpasswdFile struct {
+	file  watchedFile
+	mu    sync.RWMutex
+	users map[string]string // user -> bcrypt hash
+	// Successful checks, keyed by hash and password digest, so that
+	// bcrypt only runs once per credentials.
+	verified map[[sha256.Size]byte]struct{}
+}
+
+func newHtpasswdFile(path string) (*htpasswdFile, error) {
+	f := &htpasswdFile{file: watchedFile{path: path}}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseHtpasswd(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	s := bufio.NewScanner(file)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: invalid line", path, n)
+		}
+		if !isBcryptHash(hash) {
+			logger.Warnf("%s:%d: ignoring %s, only bcrypt hashes are supported", path, n, user)
+			continue
+		}
+		users[user] = hash
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// load reads the file. On error the previous users are kept.
+func (f *htpasswdFile) load() error {
+	if err := f.file.loaded(); err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(f.file.path)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users = users
+	f.verified = make(map[[sha256.Size]byte]struct{})
+	return nil
+}
+
+// watch reloads the file when it changes until |done| is closed.
+func (f *htpasswdFile) watch(interval time.Duration, done <-chan struct{}) {
+	pollFiles([]*watchedFile{&f.file}, interval, done, f.load)
+}
+
+func (f *htpasswdFile) check(user, password string) bool {
+	f.mu.RLock()
+	hash, ok := f.users[user]
+	f.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	digest := sha256.Sum256([]byte(hash + "\x00" + password))
+	f.mu.RLock()
+	_, cached := f.verified[digest]
+	f.mu.RUnlock()
+	if cached {
+		return true
+	}
+	if bcryptCompare(hash, []byte(password)) != nil {
+		return false
+	}
+	f.mu.Lock()
+	f.verified[digest] = struct{}{}
+	f.mu.Unlock()
+	return true
+}
+
+// BasicAuthenticator accepts Basic credentials found in an htpasswd file.
+type BasicAuthenticator struct {
+	file  *htpasswdFile
+	realm string
+}
+
+func NewBasicAuthenticator(file *htpasswdFile, realm string) *BasicAuthenticator {
+	return &BasicAuthenticator{file, realm}
+}
+
+func (a *BasicAuthenticator) Authenticate(authorization string) (Identity, error) {
+	scheme, params := splitAuthorization(authorization)
+	if !strings.EqualFold(scheme, "Basic") {
+		return Identity{}, ErrNoCredentials
+	}
+	b, err := base64.StdEncoding.DecodeString(params)
+	if err != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+	user, password, ok := strings.Cut(string(b), ":")
+	if !ok || !a.file.check(user, password) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{User: user}, nil
+}
+
+func (a *BasicAuthenticator) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", a.realm)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHtpasswd = `# test users
+alice:$2y$04$8gOsFjodkPvFVULUhTemqu3oFge.N/DtWztaf5UhWEF2jOeyjzVmG
+bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`
+
+func writeTempFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func basicCredentials(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestBasicAuthenticator(t *testing.T) {
+	f, err := newHtpasswdFile(writeTempFile(t, "htpasswd", testHtpasswd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewBasicAuthenticator(f, "test")
+
+	id, err := a.Authenticate(basicCredentials("alice", "secret"))
+	if err != nil {
+		t.Errorf("error: %v", err)
+	}
+	ExpectEqual(t, "alice", id.User)
+	// cached
+	if _, err := a.Authenticate(basicCredentials("alice", "secret")); err != nil {
+		t.Errorf("error: %v", err)
+	}
+
+	cases := []struct {
+		authorization string
+		expect        error
+	}{
+		{"", ErrNoCredentials},
+		{"Bearer xyz", ErrNoCredentials},
+		{"Basic !!!", ErrInvalidCredentials},
+		{basicCredentials("alice", "wrong"), ErrInvalidCredentials},
+		{basicCredentials("bob", "password"), ErrInvalidCredentials},
+		{basicCredentials("carol", "secret"), ErrInvalidCredentials},
+	}
+	for _, c := range cases {
+		if _, err := a.Authenticate(c.authorization); err != c.expect {
+			t.Errorf("%q: got %v, want %v", c.authorization, err, c.expect)
+		}
+	}
+	ExpectEqual(t, `Basic realm="test"`, a.Challenge())
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	path := writeTempFile(t, "htpasswd", testHtpasswd)
+	f, err := newHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, _ := f.file.changed(); changed {
+		t.Errorf("file should not be changed yet")
+	}
+
+	// A broken file keeps the previous users.
+	os.WriteFile(path, []byte("garbage\n"), 0600)
+	if changed, _ := f.file.changed(); !changed {
+		t.Errorf("file should be changed")
+	}
+	if err := f.load(); err == nil {
+		t.Errorf("broken file should fail to load")
+	}
+	if !f.check("alice", "secret") {
+		t.Errorf("previous users should be kept")
+	}
+
+	renamed := strings.Replace(testHtpasswd, "alice:", "carol:", 1)
+	os.WriteFile(path, []byte(renamed), 0600)
+	if err := f.load(); err != nil {
+		t.Fatal(err)
+	}
+	if f.check("alice", "secret") || !f.check("carol", "secret") {
+		t.Errorf("file was not reloaded")
+	}
+}
+
+func TestWorkerProxyAuthRequired(t *testing.T) {
+	f, err := newHtpasswdFile(writeTempFile(t, "htpasswd", testHtpasswd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAuth = NewBasicAuthenticator(f, "proxy")
+	defer func() { proxyAuth = nil }()
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, c)
+		go io.WriteString(c, "HTTP/1.1 204 No Content\r\n\r\n")
+		return s, nil
+	}
+
+	client, finished := runWorkerOnPipe(Timeouts{})
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	b, _ := io.ReadAll(client)
+	if !strings.HasPrefix(string(b), "HTTP/1.1 407 Proxy Authentication Required\r\n") ||
+		!strings.Contains(string(b), "Proxy-Authenticate: Basic realm=\"proxy\"\r\n") {
+		t.Errorf("unexpected response: %q", string(b))
+	}
+	<-finished
+
+	client, finished = runWorkerOnPipe(Timeouts{})
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nProxy-Authorization: " +
+		basicCredentials("alice", "secret") + "\r\n\r\n"))
+	ExpectEqual(t, "HTTP/1.1 204 No Content", readStatusLineWithin(t, client, 100*time.Millisecond))
+	client.Close() // the worker waits for the client to close
+	<-finished
+}
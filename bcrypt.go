@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// A minimal bcrypt verifier for htpasswd files, which contain $2y$, $2b$
+// or $2a$ hashes created by "htpasswd -B".
+
+var bcryptEncoding = base64.NewEncoding(
+	"./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").
+	WithPadding(base64.NoPadding)
+
+var ErrBcryptMismatch = errors.New("Password does not match")
+
+const (
+	bcryptSaltLen    = 22 // encoded length of 16 bytes
+	bcryptHashLen    = 31 // encoded length of 23 bytes
+	bcryptMinCost    = 4
+	bcryptMaxCost    = 31
+	bcryptMaxKeySize = 72
+)
+
+type blowfishState struct {
+	p              [18]uint32
+	s0, s1, s2, s3 [256]uint32
+}
+
+func newBlowfishState() *blowfishState {
+	return &blowfishState{blowfishP, blowfishS0, blowfishS1, blowfishS2, blowfishS3}
+}
+
+func (c *blowfishState) f(x uint32) uint32 {
+	return ((c.s0[x>>24] + c.s1[x>>16&0xff]) ^ c.s2[x>>8&0xff]) + c.s3[x&0xff]
+}
+
+func (c *blowfishState) encrypt(l, r uint32) (uint32, uint32) {
+	l ^= c.p[0]
+	for i := 1; i <= 16; i += 2 {
+		r ^= c.f(l) ^ c.p[i]
+		l ^= c.f(r) ^ c.p[i+1]
+	}
+	r ^= c.p[17]
+	return r, l
+}
+
+// nextWord reads 4 bytes of |b| from |*pos|, wrapping around.
+func nextWord(b []byte, pos *int) uint32 {
+	var w uint32
+	for i := 0; i < 4; i++ {
+		w = w<<8 | uint32(b[*pos])
+		*pos = (*pos + 1) % len(b)
+	}
+	return w
+}
+
+// expandKey is the Blowfish key schedule, mixing in |salt| if not nil.
+func (c *blowfishState) expandKey(key, salt []byte) {
+	j := 0
+	for i := range c.p {
+		c.p[i] ^= nextWord(key, &j)
+	}
+
+	j = 0
+	var l, r uint32
+	next := func(dst []uint32) {
+		for i := 0; i < len(dst); i += 2 {
+			if salt != nil {
+				l ^= nextWord(salt, &j)
+				r ^= nextWord(salt, &j)
+			}
+			l, r = c.encrypt(l, r)
+			dst[i], dst[i+1] = l, r
+		}
+	}
+	next(c.p[:])
+	next(c.s0[:])
+	next(c.s1[:])
+	next(c.s2[:])
+	next(c.s3[:])
+}
+
+func bcryptKey(password []byte) []byte {
+	key := append(append([]byte{}, password...), 0)
+	if len(key) > bcryptMaxKeySize {
+		key = key[:bcryptMaxKeySize]
+	}
+	return key
+}
+
+// bcryptRaw returns the encoded hash part for |password|.
+func bcryptRaw(password []byte, cost int, salt []byte) string {
+	key := bcryptKey(password)
+	c := newBlowfishState()
+	c.expandKey(key, salt)
+	for i := uint64(0); i < 1<<uint(cost); i++ {
+		c.expandKey(key, nil)
+		c.expandKey(salt, nil)
+	}
+
+	data := []byte("OrpheanBeholderScryDoubt")
+	for i := 0; i < len(data); i += 8 {
+		l := binary.BigEndian.Uint32(data[i:])
+		r := binary.BigEndian.Uint32(data[i+4:])
+		for j := 0; j < 64; j++ {
+			l, r = c.encrypt(l, r)
+		}
+		binary.BigEndian.PutUint32(data[i:], l)
+		binary.BigEndian.PutUint32(data[i+4:], r)
+	}
+	return bcryptEncoding.EncodeToString(data[:23])
+}
+
+// parseBcrypt splits "$2y$10$<salt><hash>" into its parts.
+func parseBcrypt(hash string) (cost int, salt []byte, sum string, err error) {
+	const prefixLen = 7 // "$2y$10$"
+	if len(hash) != prefixLen+bcryptSaltLen+bcryptHashLen ||
+		hash[0] != '$' || hash[1] != '2' || hash[3] != '$' || hash[6] != '$' {
+		return 0, nil, "", fmt.Errorf("Not a bcrypt hash")
+	}
+	switch hash[2] {
+	case 'a', 'b', 'y':
+	default:
+		return 0, nil, "", fmt.Errorf("Unsupported bcrypt version: %s", hash[:3])
+	}
+	cost, err = strconv.Atoi(hash[4:6])
+	if err != nil || cost < bcryptMinCost || cost > bcryptMaxCost {
+		return 0, nil, "", fmt.Errorf("Invalid bcrypt cost: %s", hash[4:6])
+	}
+	salt, err = bcryptEncoding.DecodeString(hash[prefixLen : prefixLen+bcryptSaltLen])
+	if err != nil {
+		return 0, nil, "", fmt.Errorf("Invalid bcrypt salt: %v", err)
+	}
+	return cost, salt, hash[prefixLen+bcryptSaltLen:], nil
+}
+
+func isBcryptHash(hash string) bool {
+	_, _, _, err := parseBcrypt(hash)
+	return err == nil
+}
+
+// bcryptCompare returns nil if |password| matches |hash|.
+func bcryptCompare(hash string, password []byte) error {
+	cost, salt, sum, err := parseBcrypt(hash)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(bcryptRaw(password, cost, salt)), []byte(sum)) != 1 {
+		return ErrBcryptMismatch
+	}
+	return nil
+}
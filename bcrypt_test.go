@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBcryptCompare(t *testing.T) {
+	cases := []struct {
+		password, hash string
+	}{
+		{"secret", "$2a$04$8gOsFjodkPvFVULUhTemqu3oFge.N/DtWztaf5UhWEF2jOeyjzVmG"},
+		{"", "$2a$04$vK6h4gabjqP4HVeYe.E/n.te4NwTNzhgKUawZxJWurEWgOoNp2CmK"},
+		{"correct horse battery staple", "$2a$04$v933mKy6dzYbuYTVhWRPNel3X5iLOdjtFnCK.SiIsjlWHH56lTrbu"},
+		// htpasswd writes $2y$
+		{"s3cr3t", "$2y$05$8frOvg87s0OpdsokSfI0veLggBA9mjrOrTgVRuQSWkB5Wgrdf.uA2"},
+	}
+	for _, c := range cases {
+		if err := bcryptCompare(c.hash, []byte(c.password)); err != nil {
+			t.Errorf("%q: %v", c.password, err)
+		}
+		if err := bcryptCompare(c.hash, []byte(c.password+"x")); err != ErrBcryptMismatch {
+			t.Errorf("%q: got %v, want mismatch", c.password+"x", err)
+		}
+	}
+}
+
+func TestBcryptLongPassword(t *testing.T) {
+	// Only the first 72 bytes are significant.
+	salt := []byte("0123456789abcdef")
+	a := bcryptRaw([]byte(strings.Repeat("a", 72)+"b"), 4, salt)
+	b := bcryptRaw([]byte(strings.Repeat("a", 72)+"c"), 4, salt)
+	ExpectEqual(t, a, b)
+}
+
+func TestParseBcryptErrors(t *testing.T) {
+	for _, h := range []string{
+		"",
+		"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"$1$8gOsFjodkPvFVULUhTemqu3oFge.N/DtWztaf5UhWEF2jOeyjzVmG",
+		"$2x$04$8gOsFjodkPvFVULUhTemqu3oFge.N/DtWztaf5UhWEF2jOeyjzVmG",
+		"$2a$03$8gOsFjodkPvFVULUhTemqu3oFge.N/DtWztaf5UhWEF2jOeyjzVmG",
+		"$2a$04$8gOsFjodkPvFVULUhTemqu3oFge.N/DtWztaf5UhWEF2jOeyjzVm",
+	} {
+		if isBcryptHash(h) {
+			t.Errorf("%q should not parse", h)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// domainSet answers whether a host or any of its parent domains is listed.
+// Lookups take one map access per label of the host.
+type domainSet struct {
+	exact  map[string]struct{}
+	suffix map[string]struct{} // also matches subdomains
+}
+
+func newDomainSet() *domainSet {
+	return &domainSet{make(map[string]struct{}), make(map[string]struct{})}
+}
+
+func (s *domainSet) add(domain string) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	switch {
+	case strings.HasPrefix(domain, "*."):
+		s.suffix[domain[2:]] = struct{}{}
+	case strings.HasPrefix(domain, "."):
+		s.exact[domain[1:]] = struct{}{}
+		s.suffix[domain[1:]] = struct{}{}
+	default:
+		s.exact[domain] = struct{}{}
+	}
+}
+
+func (s *domainSet) contains(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, ok := s.exact[host]; ok {
+		return true
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		host = host[i+1:]
+		if _, ok := s.suffix[host]; ok {
+			return true
+		}
+		i = strings.IndexByte(host, '.')
+	}
+	return false
+}
+
+func (s *domainSet) size() int {
+	return len(s.exact) + len(s.suffix)
+}
+
+// parseBlocklist reads hosts-file lines ("0.0.0.0 ads.example.com") and
+// plain domain lines ("ads.example.com"). "*.example.com" blocks all
+// subdomains and ".example.com" the domain and all subdomains.
+func parseBlocklist(r io.Reader, s *domainSet) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:] // hosts file format
+		}
+		for _, d := range fields {
+			switch d {
+			case "localhost", "localhost.localdomain", "local", "broadcasthost":
+				continue
+			}
+			s.add(d)
+		}
+	}
+	return sc.Err()
+}
+
+// Blocklist blocks domains listed in one or more files, which are
+// reloaded when they change.
+type Blocklist struct {
+	files []*watchedFile
+	set   atomic.Pointer[domainSet]
+	// Sent to blocked requests. nil means 403.
+	Sinkhole     *Response
+	SinkholeBody []byte
+}
+
+func NewBlocklist(paths []string) (*Blocklist, error) {
+	b := &Blocklist{}
+	for _, p := range paths {
+		b.files = append(b.files, &watchedFile{path: p})
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// load reads all files into a new set. On error the previous set is kept.
+func (b *Blocklist) load() error {
+	s := newDomainSet()
+	for _, f := range b.files {
+		if err := f.loaded(); err != nil {
+			return err
+		}
+		file, err := os.Open(f.path)
+		if err != nil {
+			return err
+		}
+		err = parseBlocklist(file, s)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.path, err)
+		}
+	}
+	b.set.Store(s)
+	logger.Infof("blocklist: %d domains", s.size())
+	return nil
+}
+
+func (b *Blocklist) watch(interval time.Duration, done <-chan struct{}) {
+	pollFiles(b.files, interval, done, b.load)
+}
+
+func (b *Blocklist) Blocked(host string) bool {
+	if b == nil {
+		return false
+	}
+	return b.set.Load().contains(host)
+}
+
+// response returns the response for a blocked request. CONNECT gets 403
+// unless the sinkhole is an error itself, since a 2xx would tell the
+// client that a tunnel was established.
+func (b *Blocklist) response(method string) (*Response, []byte) {
+	if b.Sinkhole == nil || (method == "CONNECT" && b.Sinkhole.Status < 300) {
+		return ResponseForbidden, nil
+	}
+	return b.Sinkhole, b.SinkholeBody
+}
+
+// newSinkholeResponse builds a response with |status| and |body|. 204 and
+// 304 responses can't have a body, nor a Content-Length for 204.
+func newSinkholeResponse(status int, contentType string, body []byte) (*Response, error) {
+	if status < 200 || status > 599 {
+		return nil, fmt.Errorf("Invalid sinkhole status: %d", status)
+	}
+	noBody := status == 204 || status == 304
+	if noBody && len(body) > 0 {
+		return nil, fmt.Errorf("Sinkhole status %d can't have a body", status)
+	}
+	res := &Response{
+		Version: "HTTP/1.1",
+		Status:  status,
+		Phrase:  http.StatusText(status),
+		Headers: HTTPHeader{"cache-control": "no-store"},
+	}
+	if !noBody {
+		res.Headers["content-length"] = strconv.Itoa(len(body))
+	}
+	if len(body) > 0 {
+		res.Headers["content-type"] = contentType
+	}
+	return res, nil
+}
+
+// Used by workers created from now on. nil disables blocking.
+var blocklist *Blocklist
+
+// stringsFlag collects a repeatable string flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHostsFile = `# ad servers
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # inline comment
+::1 ip6-localhost
+`
+
+const testDomainList = `
+malware.test
+*.doubleclick.test
+.tracking.test
+`
+
+func TestDomainSet(t *testing.T) {
+	s := newDomainSet()
+	if err := parseBlocklist(strings.NewReader(testHostsFile+testDomainList), s); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"ads.example.com":       true,
+		"ADS.example.com.":      true,
+		"www.ads.example.com":   false,
+		"example.com":           false,
+		"localhost":             false,
+		"malware.test":          true,
+		"a.malware.test":        false,
+		"doubleclick.test":      false,
+		"ad.doubleclick.test":   true,
+		"x.ad.doubleclick.test": true,
+		"tracking.test":         true,
+		"a.b.tracking.test":     true,
+		"nottracking.test":      false,
+	}
+	for host, expect := range cases {
+		if got := s.contains(host); got != expect {
+			t.Errorf("contains(%q) = %v", host, got)
+		}
+	}
+}
+
+func TestBlocklistReload(t *testing.T) {
+	hosts := writeTempFile(t, "hosts", testHostsFile)
+	domains := writeTempFile(t, "domains", testDomainList)
+	b, err := NewBlocklist([]string{hosts, domains})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Blocked("ads.example.com") || !b.Blocked("malware.test") {
+		t.Errorf("domains not loaded")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go b.watch(10*time.Millisecond, done)
+	os.WriteFile(domains, []byte("evil.test\n"), 0600)
+	for i := 0; i < 100 && !b.Blocked("evil.test"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !b.Blocked("evil.test") || b.Blocked("malware.test") || !b.Blocked("ads.example.com") {
+		t.Errorf("blocklist not reloaded")
+	}
+}
+
+func TestBlocklistResponse(t *testing.T) {
+	b := &Blocklist{}
+	if res, _ := b.response("GET"); res != ResponseForbidden {
+		t.Errorf("got %v, want 403", res)
+	}
+	body := []byte("<html>blocked</html>")
+	b.Sinkhole, _ = newSinkholeResponse(200, "text/html", body)
+	b.SinkholeBody = body
+	res, got := b.response("GET")
+	if res.Status != 200 || string(got) != string(body) || res.Headers["content-length"] != "20" {
+		t.Errorf("unexpected sinkhole: %v %q", res, got)
+	}
+	if res, _ := b.response("CONNECT"); res != ResponseForbidden {
+		t.Errorf("CONNECT should get 403, got %v", res)
+	}
+}
+
+func TestNewSinkholeResponse(t *testing.T) {
+	for _, c := range []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{302, "", "302 Found 0 <nil>"},
+		{503, "down", "503 Service Unavailable 4 <nil>"},
+		{204, "", "204 No Content  <nil>"},
+		{304, "", "304 Not Modified  <nil>"},
+		{204, "x", "Sinkhole status 204 can't have a body"},
+		{304, "x", "Sinkhole status 304 can't have a body"},
+		{1, "", "Invalid sinkhole status: 1"},
+		{999, "", "Invalid sinkhole status: 999"},
+	} {
+		res, err := newSinkholeResponse(c.status, "text/plain", []byte(c.body))
+		got := fmt.Sprint(err)
+		if err == nil {
+			got = fmt.Sprint(res.Status, " ", res.Phrase, " ", res.Headers["content-length"], " ", err)
+		}
+		ExpectEqual(t, c.want, got)
+	}
+}
+
+func TestWorkerSinkholeHead(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	b, err := NewBlocklist([]string{writeTempFile(t, "domains", testDomainList)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte("<html>blocked</html>")
+	b.Sinkhole, _ = newSinkholeResponse(200, "text/html", body)
+	b.SinkholeBody = body
+	blocklist = b
+	defer func() { blocklist = nil }()
+
+	for _, method := range []string{"GET", "HEAD"} {
+		client, finished := runWorkerOnPipe(Timeouts{})
+		go io.WriteString(client, method+" http://malware.test/ HTTP/1.1\r\nHost: malware.test\r\n\r\n")
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		got, _ := io.ReadAll(client)
+		_, sent, _ := strings.Cut(string(got), "\r\n\r\n")
+		ExpectEqual(t, method+" "+map[string]string{"GET": string(body)}[method], method+" "+sent)
+		client.Close()
+		<-finished
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// byteRange is a range of a body, with |end| excluded.
+type byteRange struct {
+	start, end int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end-1, size)
+}
+
+// parseRange parses a Range header against a body of |size| bytes, RFC
+// 9110 section 14.1.2. It returns ok false if the header is invalid or not
+// in bytes, and no ranges if none is satisfiable.
+func parseRange(v string, size int64) (ranges []byteRange, ok bool) {
+	unit, set, found := strings.Cut(v, "=")
+	if !found || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, false
+	}
+	for _, spec := range strings.Split(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, found := strings.Cut(spec, "-")
+		if !found {
+			return nil, false
+		}
+		var r byteRange
+		if first == "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			r = byteRange{max(size-n, 0), size}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, false
+			}
+			r = byteRange{start, size}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, false
+				}
+				if end < size {
+					r.end = end + 1
+				}
+			}
+		}
+		if r.start < r.end {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges, true
+}
+
+// ifRangeMatches evaluates If-Range against |res|, RFC 9110 section
+// 13.1.5. Only strong validators match.
+func ifRangeMatches(v string, res *Response) bool {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, `"`) {
+		return v == res.Headers["etag"]
+	}
+	if strings.HasPrefix(v, "W/") {
+		return false
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(res.Headers["last-modified"])
+	return err == nil && lm.Equal(t)
+}
+
+// rangeResponse is a 206 or 416 response made from a complete response.
+type rangeResponse struct {
+	res         *Response
+	ranges      []byteRange
+	size        int64
+	contentType string // of the complete response
+	boundary    string // for multiple ranges
+}
+
+// newRangeResponse returns the response to a GET request with the headers
+// |h| for the complete 200 response |res|, or nil if the request is to be
+// answered with |res|.
+func newRangeResponse(h HTTPHeader, res *Response) *rangeResponse {
+	v, ok := h["range"]
+	if !ok || res.Status != 200 {
+		return nil
+	}
+	if ir, ok := h["if-range"]; ok && !ifRangeMatches(ir, res) {
+		return nil
+	}
+	size, err := contentLength(res.Headers)
+	if err != nil {
+		return nil
+	}
+	ranges, ok := parseRange(v, int64(size))
+	if !ok {
+		return nil
+	}
+	r := &rangeResponse{ranges: ranges, size: int64(size), contentType: res.Headers["content-type"]}
+	headers := make(HTTPHeader, len(res.Headers)+1)
+	for k, v := range res.Headers {
+		headers[k] = v
+	}
+	if len(ranges) == 0 {
+		headers["content-range"] = "bytes */" + strconv.FormatInt(r.size, 10)
+		headers["content-length"] = "0"
+		delete(headers, "content-type")
+		r.res = &Response{res.Version, 416, "Range Not Satisfiable", headers}
+		return r
+	}
+	// Like net/http, overlapping ranges costing more than the whole body
+	// are answered with the whole body.
+	var total int64
+	for _, br := range ranges {
+		total += br.end - br.start
+	}
+	if total > r.size {
+		return nil
+	}
+	r.res = &Response{res.Version, 206, "Partial Content", headers}
+	if len(ranges) == 1 {
+		headers["content-range"] = ranges[0].contentRange(r.size)
+		headers["content-length"] = strconv.FormatInt(total, 10)
+		return r
+	}
+	var b [12]byte
+	rand.Read(b[:])
+	r.boundary = hex.EncodeToString(b[:])
+	headers["content-type"] = "multipart/byteranges; boundary=" + r.boundary
+	n := int64(len(r.closing()))
+	for i, br := range ranges {
+		n += int64(len(r.partHeader(i))) + br.end - br.start
+	}
+	headers["content-length"] = strconv.FormatInt(n, 10)
+	return r
+}
+
+// partHeader is what precedes range |i| in a multipart/byteranges body.
+func (r *rangeResponse) partHeader(i int) string {
+	var b strings.Builder
+	if i > 0 {
+		b.WriteString("\r\n")
+	}
+	b.WriteString("--" + r.boundary + "\r\n")
+	if r.contentType != "" {
+		b.WriteString("Content-Type: " + r.contentType + "\r\n")
+	}
+	b.WriteString("Content-Range: " + r.ranges[i].contentRange(r.size) + "\r\n\r\n")
+	return b.String()
+}
+
+func (r *rangeResponse) closing() string {
+	return "\r\n--" + r.boundary + "--\r\n"
+}
+
+// writeBody copies the ranges of |body| to |w|.
+func (r *rangeResponse) writeBody(w io.Writer, body io.ReadSeeker) error {
+	for i, br := range r.ranges {
+		if r.boundary != "" {
+			if _, err := io.WriteString(w, r.partHeader(i)); err != nil {
+				return err
+			}
+		}
+		if _, err := body.Seek(br.start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, body, br.end-br.start); err != nil {
+			return err
+		}
+	}
+	if r.boundary != "" {
+		_, err := io.WriteString(w, r.closing())
+		return err
+	}
+	return nil
+}
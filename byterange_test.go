@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		want   string
+	}{
+		{"bytes=0-9", "[{0 10}] true"},
+		{"bytes=5-", "[{5 100}] true"},
+		{"bytes=-10", "[{90 100}] true"},
+		{"bytes=-200", "[{0 100}] true"},
+		{"bytes=90-200", "[{90 100}] true"},
+		{"Bytes = 0-0, 10-19 ,", "[{0 1} {10 20}] true"},
+		{"bytes=100-, -0", "[] true"},
+		{"bytes=200-300, 0-1", "[{0 2}] true"},
+		{"bytes=9-1", "[] false"},
+		{"bytes=x-1", "[] false"},
+		{"bytes=1", "[] false"},
+		{"items=0-1", "[] false"},
+	} {
+		ranges, ok := parseRange(c.header, 100)
+		ExpectEqual(t, c.header+" "+c.want, fmt.Sprint(c.header, " ", ranges, " ", ok))
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	lm := cacheEpoch.Format(http.TimeFormat)
+	res := cacheResponse(`ETag: "v1"`, "Last-Modified: "+lm)
+	for _, c := range []struct {
+		header string
+		want   bool
+	}{
+		{`"v1"`, true},
+		{`"v2"`, false},
+		{`W/"v1"`, false},
+		{lm, true},
+		{cacheEpoch.Add(time.Second).Format(http.TimeFormat), false},
+		{"invalid", false},
+	} {
+		ExpectEqual(t, c.header+" "+fmt.Sprint(c.want), c.header+" "+fmt.Sprint(ifRangeMatches(c.header, res)))
+	}
+}
+
+// rangeBody writes the response to |h| for a response with |body|.
+func rangeBody(t *testing.T, h HTTPHeader, body string) (*rangeResponse, string) {
+	res := cacheResponse("Content-Type: text/plain", "Content-Length: "+fmt.Sprint(len(body)))
+	r := newRangeResponse(h, res)
+	if r == nil {
+		return nil, ""
+	}
+	var b bytes.Buffer
+	if err := r.writeBody(&b, strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, r.res.Headers["content-length"], fmt.Sprint(b.Len()))
+	return r, b.String()
+}
+
+func TestRangeResponse(t *testing.T) {
+	body := "0123456789"
+	r, got := rangeBody(t, HTTPHeader{"range": "bytes=2-4"}, body)
+	ExpectEqual(t, "206 bytes 2-4/10 234", fmt.Sprint(r.res.Status, " ",
+		r.res.Headers["content-range"], " ", got))
+
+	r, got = rangeBody(t, HTTPHeader{"range": "bytes=0-1, -2"}, body)
+	ExpectEqual(t, "206", fmt.Sprint(r.res.Status))
+	mediaType, params, _ := mime.ParseMediaType(r.res.Headers["content-type"])
+	ExpectEqual(t, "multipart/byteranges", mediaType)
+	mr := multipart.NewReader(strings.NewReader(got), params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Type")+" "+p.Header.Get("Content-Range")+" "+string(b))
+	}
+	ExpectEqual(t, "text/plain bytes 0-1/10 01|text/plain bytes 8-9/10 89", strings.Join(parts, "|"))
+
+	r, got = rangeBody(t, HTTPHeader{"range": "bytes=10-"}, body)
+	ExpectEqual(t, "416 bytes */10 ", fmt.Sprint(r.res.Status, " ", r.res.Headers["content-range"], " ", got))
+
+	for _, h := range []HTTPHeader{
+		{},
+		{"range": "bytes=0-5, 2-9"}, // more than the whole body
+		{"range": "lines=1-2"},
+		{"range": "bytes=0-1", "if-range": `"v0"`},
+	} {
+		if r, _ := rangeBody(t, h, body); r != nil {
+			t.Errorf("%v: got %d, want the whole body", h, r.res.Status)
+		}
+	}
+}
+
+func TestWorkerRange(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	defer func() { responseCache = nil }()
+	responseCache = NewCache(newMemoryStore(1<<20), nil, 1<<20)
+
+	var dials atomic.Int32
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		dials.Add(1)
+		s, c := net.Pipe()
+		go func() {
+			req, err := http.ReadRequest(bufio.NewReader(c))
+			if err != nil {
+				return
+			}
+			if v := req.Header.Get("Range"); v != "" {
+				fmt.Fprintf(c, "HTTP/1.1 206 Partial Content\r\nCache-Control: max-age=60\r\n"+
+					"Content-Range: bytes 0-1/10\r\nContent-Length: 2\r\n\r\n01")
+			} else {
+				fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\nETag: \"v1\"\r\n"+
+					"Content-Length: 10\r\n\r\n0123456789")
+			}
+			io.Copy(io.Discard, c)
+		}()
+		return s, nil
+	}
+	get := func(headers string) string {
+		res, body := proxyResponseOnPipe(t, "GET http://cached.example/x HTTP/1.1\r\n"+
+			"Host: cached.example\r\n"+headers+"\r\n")
+		return fmt.Sprint(res.StatusCode, " ", res.Header.Get("Content-Range"), " ", body)
+	}
+	// A miss is forwarded and the partial response not stored.
+	ExpectEqual(t, "206 bytes 0-1/10 01", get("Range: bytes=0-1\r\n"))
+	ExpectEqual(t, "200  0123456789", get(""))
+	ExpectEqual(t, "2", fmt.Sprint(dials.Load()))
+
+	ExpectEqual(t, "206 bytes 7-9/10 789", get("Range: bytes=-3\r\n"))
+	ExpectEqual(t, "206 bytes 1-2/10 12", get("Range: bytes=1-2\r\nIf-Range: \"v1\"\r\n"))
+	ExpectEqual(t, "200  0123456789", get("Range: bytes=1-2\r\nIf-Range: \"v0\"\r\n"))
+	ExpectEqual(t, "416 bytes */10 ", get("Range: bytes=20-\r\n"))
+	ExpectEqual(t, "2", fmt.Sprint(dials.Load()))
+}
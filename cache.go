@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheControl holds Cache-Control directives by lowercase name, with
+// unquoted values.
+type cacheControl map[string]string
+
+func parseCacheControl(v string) cacheControl {
+	cc := cacheControl{}
+	for _, d := range strings.Split(v, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if name == "" {
+			continue
+		}
+		cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the delta-seconds value of |name|. Invalid values are
+// treated as zero, as RFC 9111 requires for max-age.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return deltaSeconds(n), true
+}
+
+// deltaSeconds caps |n| at 2^31 as RFC 9111 section 1.2.2 allows.
+func deltaSeconds(n int64) time.Duration {
+	if n > 1<<31 {
+		n = 1 << 31
+	}
+	return time.Duration(n) * time.Second
+}
+
+// requestCacheControl includes "Pragma: no-cache" if there is no
+// Cache-Control.
+func requestCacheControl(h HTTPHeader) cacheControl {
+	v, ok := h["cache-control"]
+	if !ok && strings.EqualFold(strings.TrimSpace(h["pragma"]), "no-cache") {
+		v = "no-cache"
+	}
+	return parseCacheControl(v)
+}
+
+// Heuristic freshness is a tenth of the time since Last-Modified, up to
+// this.
+const heuristicMaxLifetime = 24 * time.Hour
+
+// Statuses cacheable by default, RFC 9110 section 15.1.
+var heuristicStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// cacheEntry is a stored response, or a marker naming the Vary fields of
+// the responses stored for a URL.
+type cacheEntry struct {
+	res          *Response // hop-by-hop fields removed, Content-Length set
+	body         []byte    // decoded, unless in bodyFile
+	bodyFile     string    // body in a file of the disk store
+	bodySize     int64
+	requestTime  time.Time // request sent upstream
+	responseTime time.Time // response header received
+	initialAge   time.Duration
+	lifetime     time.Duration
+
+	// Markers only.
+	vary []string // lowercase field names
+	gen  uint64   // part of the keys of the variants
+}
+
+func (e *cacheEntry) isMarker() bool {
+	return e.res == nil
+}
+
+// size is the memory used by the entry.
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.body)) + 256
+	if e.res != nil {
+		for k, v := range e.res.Headers {
+			n += int64(len(k) + len(v))
+		}
+	}
+	for _, v := range e.vary {
+		n += int64(len(v))
+	}
+	return n
+}
+
+// openBody returns the body. Bodies in files are streamed from them.
+func (e *cacheEntry) openBody() (io.ReadSeekCloser, error) {
+	if e.bodyFile == "" {
+		return nopSeekCloser{bytes.NewReader(e.body)}, nil
+	}
+	f, err := os.Open(e.bodyFile)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != e.bodySize {
+		f.Close()
+		return nil, fmt.Errorf("%s: Body changed since stored", e.bodyFile)
+	}
+	return f, nil
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// age is current_age of RFC 9111 section 4.2.3.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.responseTime)
+}
+
+func (e *cacheEntry) cacheControl() cacheControl {
+	return parseCacheControl(e.res.Headers["cache-control"])
+}
+
+// freshnessLifetime implements RFC 9111 section 4.2.1 for a shared cache.
+func freshnessLifetime(res *Response, cc cacheControl) time.Duration {
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date, dateErr := http.ParseTime(res.Headers["date"])
+	if v, ok := res.Headers["expires"]; ok {
+		expires, err := http.ParseTime(v)
+		if err != nil || dateErr != nil {
+			return 0
+		}
+		return max(expires.Sub(date), 0)
+	}
+	if lm, err := http.ParseTime(res.Headers["last-modified"]); err == nil && dateErr == nil &&
+		(heuristicStatuses[res.Status] || cc.has("public")) {
+		if d := date.Sub(lm) / 10; d < heuristicMaxLifetime {
+			return d
+		}
+		return heuristicMaxLifetime
+	}
+	return 0
+}
+
+// initialAge is corrected_initial_age of RFC 9111 section 4.2.3.
+func initialAge(res *Response, requestTime, responseTime time.Time) time.Duration {
+	var apparent time.Duration
+	if date, err := http.ParseTime(res.Headers["date"]); err == nil {
+		apparent = max(responseTime.Sub(date), 0)
+	}
+	var age time.Duration
+	if n, err := strconv.ParseInt(res.Headers["age"], 10, 64); err == nil && n > 0 {
+		age = deltaSeconds(n)
+	}
+	return max(apparent, age+responseTime.Sub(requestTime))
+}
+
+// cacheStore keeps entries by key.
+type cacheStore interface {
+	get(key string) *cacheEntry
+	put(key string, e *cacheEntry)
+	remove(key string)
+}
+
+// memoryStore evicts the least recently used entries beyond its size.
+type memoryStore struct {
+	mu    sync.Mutex
+	max   int64
+	size  int64
+	lru   *list.List // of *memoryItem, most recently used first
+	items map[string]*list.Element
+}
+
+type memoryItem struct {
+	key string
+	e   *cacheEntry
+}
+
+func newMemoryStore(max int64) *memoryStore {
+	return &memoryStore{max: max, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (s *memoryStore) get(key string) *cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).e
+}
+
+func (s *memoryStore) put(key string, e *cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.removeElement(el)
+	}
+	s.items[key] = s.lru.PushFront(&memoryItem{key, e})
+	s.grow(e.size())
+	for s.size > s.max && s.lru.Len() > 1 {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+func (s *memoryStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.removeElement(el)
+	}
+}
+
+func (s *memoryStore) removeElement(el *list.Element) {
+	item := s.lru.Remove(el).(*memoryItem)
+	delete(s.items, item.key)
+	s.grow(-item.e.size())
+}
+
+func (s *memoryStore) grow(n int64) {
+	s.size += n
+	metrics.CacheBytes.add(float64(n), "memory")
+}
+
+// tieredStore keeps bodies spilled to files on disk, markers in both
+// tiers and the rest in memory, if it has any. The disk tier is optional.
+type tieredStore struct {
+	mem  *memoryStore
+	disk *diskStore
+}
+
+func (s tieredStore) get(key string) *cacheEntry {
+	if e := s.mem.get(key); e != nil || s.disk == nil {
+		return e
+	}
+	return s.disk.get(key)
+}
+
+func (s tieredStore) put(key string, e *cacheEntry) {
+	switch {
+	case s.disk == nil:
+		s.mem.put(key, e)
+	case e.isMarker():
+		s.mem.put(key, e)
+		s.disk.put(key, e)
+	case e.bodyFile != "" || s.mem.max == 0:
+		s.mem.remove(key)
+		s.disk.put(key, e)
+	default:
+		s.disk.remove(key)
+		s.mem.put(key, e)
+	}
+}
+
+func (s tieredStore) remove(key string) {
+	s.mem.remove(key)
+	if s.disk != nil {
+		s.disk.remove(key)
+	}
+}
+
+// Cache is a shared HTTP cache as in RFC 9111, for GET and HEAD requests.
+// Responses are keyed by URL; a marker at the URL names the fields of
+// Vary, and each variant is keyed by the URL and the request values of
+// these fields.
+type Cache struct {
+	store        cacheStore
+	maxMemObject int64  // larger bodies are spilled to spillDir
+	maxObject    int64  // largest body stored
+	spillDir     string // empty without a disk tier
+	gen          atomic.Uint64
+
+	fetchMu sync.Mutex
+	fetches map[string]*cacheFetch // by URL, see joinFetch
+}
+
+// Set by -cache-size or -cache-dir, nil if caching is disabled.
+var responseCache *Cache
+
+// NewCache keeps bodies up to |maxMemObject| in |mem| and larger ones in
+// |disk|, which may be nil.
+func NewCache(mem *memoryStore, disk *diskStore, maxMemObject int64) *Cache {
+	c := &Cache{
+		store:        tieredStore{mem, disk},
+		maxMemObject: maxMemObject,
+		maxObject:    maxMemObject,
+		fetches:      make(map[string]*cacheFetch),
+	}
+	if disk != nil {
+		c.maxObject = disk.maxObject
+		c.spillDir = disk.dir
+	}
+	// Markers of a previous run stay on disk, so generations must not
+	// repeat across restarts.
+	c.gen.Store(uint64(time.Now().UnixNano()))
+	return c
+}
+
+// Results of Cache.lookup, also the label values of Metrics.CacheLookups.
+const (
+	CacheHit    = "hit"
+	CacheMiss   = "miss"
+	CacheStale  = "stale"
+	CacheBypass = "bypass" // the request asked not to use the cache
+)
+
+func variantKey(url string, gen uint64, vary []string, h HTTPHeader) string {
+	var b strings.Builder
+	b.WriteString(url)
+	b.WriteString("\x00")
+	b.WriteString(strconv.FormatUint(gen, 10))
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(strings.Join(strings.Fields(h[name]), " "))
+	}
+	return b.String()
+}
+
+// entry returns the response stored for |req|, or nil.
+func (c *Cache) entry(req *Request) *cacheEntry {
+	url := requestURL(req)
+	e := c.store.get(url)
+	if e == nil || !e.isMarker() {
+		return e
+	}
+	return c.store.get(variantKey(url, e.gen, e.vary, req.Headers))
+}
+
+// lookup returns a stored response usable for |req| at |now|.
+func (c *Cache) lookup(req *Request, now time.Time) (*cacheEntry, string) {
+	reqCC := requestCacheControl(req.Headers)
+	if reqCC.has("no-cache") || reqCC.has("no-store") {
+		return nil, CacheBypass
+	}
+	e := c.entry(req)
+	if e == nil {
+		return nil, CacheMiss
+	}
+	cc := e.cacheControl()
+	age := e.age(now)
+	if d, ok := reqCC.seconds("max-age"); ok && age > d {
+		return e, CacheStale
+	}
+	left := e.lifetime - age
+	if d, ok := reqCC.seconds("min-fresh"); ok {
+		left -= d
+	}
+	if cc.has("no-cache") {
+		return e, CacheStale
+	}
+	if left > 0 {
+		return e, CacheHit
+	}
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("s-maxage") {
+		return e, CacheStale
+	}
+	if v, ok := reqCC["max-stale"]; ok {
+		if d, _ := reqCC.seconds("max-stale"); v == "" || -left <= d {
+			return e, CacheHit
+		}
+	}
+	return e, CacheStale
+}
+
+// storable implements RFC 9111 section 3 for a shared cache.
+func (c *Cache) storable(req *Request, res *Response, lifetime time.Duration) bool {
+	if req.Method != "GET" || res.Status < 200 || res.Status == 206 || res.Status == 304 {
+		return false
+	}
+	cc := parseCacheControl(res.Headers["cache-control"])
+	reqCC := requestCacheControl(req.Headers)
+	if reqCC.has("no-store") || cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	if _, ok := req.Headers["authorization"]; ok &&
+		!cc.has("public") && !cc.has("must-revalidate") && !cc.has("s-maxage") {
+		return false
+	}
+	// Cookies of one user must not reach others.
+	if _, ok := res.Headers["set-cookie"]; ok {
+		return false
+	}
+	if strings.TrimSpace(res.Headers["vary"]) == "*" {
+		return false
+	}
+	// Responses stale from the start are kept if they can be revalidated.
+	return lifetime > 0 || hasValidator(res.Headers)
+}
+
+func hasValidator(h HTTPHeader) bool {
+	return h["etag"] != "" || h["last-modified"] != ""
+}
+
+// put stores the response to |req| if it may be. |body| is decoded and
+// complete.
+func (c *Cache) put(req *Request, res *Response, body []byte, requestTime, responseTime time.Time) bool {
+	if int64(len(body)) > c.maxMemObject {
+		return false
+	}
+	return c.add(req, res, &cacheEntry{body: body, bodySize: int64(len(body)),
+		requestTime: requestTime, responseTime: responseTime})
+}
+
+// add stores |e| with the body set as the response to |req|.
+func (c *Cache) add(req *Request, res *Response, e *cacheEntry) bool {
+	lifetime := freshnessLifetime(res, parseCacheControl(res.Headers["cache-control"]))
+	if !c.storable(req, res, lifetime) {
+		return false
+	}
+	if cl, err := contentLength(res.Headers); err == nil && int64(cl) != e.bodySize {
+		return false
+	}
+	headers := make(HTTPHeader, len(res.Headers))
+	for k, v := range res.Headers {
+		headers[k] = v
+	}
+	RemoveHopByHopHeaders(headers)
+	headers["content-length"] = strconv.FormatInt(e.bodySize, 10)
+	e.res = &Response{res.Version, res.Status, res.Phrase, headers}
+	e.initialAge = initialAge(res, e.requestTime, e.responseTime)
+	e.lifetime = lifetime
+
+	url := requestURL(req)
+	var vary []string
+	for _, name := range strings.Split(res.Headers["vary"], ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			vary = append(vary, name)
+		}
+	}
+	if len(vary) == 0 {
+		c.store.put(url, e)
+		return true
+	}
+	marker := c.store.get(url)
+	if marker == nil || !marker.isMarker() || strings.Join(marker.vary, ",") != strings.Join(vary, ",") {
+		marker = &cacheEntry{vary: vary, gen: c.gen.Add(1)}
+		c.store.put(url, marker)
+	}
+	c.store.put(variantKey(url, marker.gen, vary, req.Headers), e)
+	return true
+}
+
+// invalidate forgets the responses stored for |url|, e.g. after a POST.
+func (c *Cache) invalidate(url string) {
+	// Variants are no longer reachable and age out.
+	c.store.remove(url)
+}
+
+// response returns the stored response as sent to a client at |now|.
+func (e *cacheEntry) response(now time.Time) *Response {
+	headers := make(HTTPHeader, len(e.res.Headers)+2)
+	for k, v := range e.res.Headers {
+		headers[k] = v
+	}
+	headers["age"] = strconv.FormatInt(int64(e.age(now)/time.Second), 10)
+	headers["cache-status"] = "proxy; hit"
+	return &Response{e.res.Version, e.res.Status, e.res.Phrase, headers}
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since of a GET or
+// HEAD request with the headers |h| against |res|, RFC 9110 section 13.2.2.
+func notModified(h HTTPHeader, res *Response) bool {
+	if v, ok := h["if-none-match"]; ok {
+		return etagMatches(v, res.Headers["etag"])
+	}
+	ims, err := http.ParseTime(h["if-modified-since"])
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(res.Headers["last-modified"])
+	return err == nil && !lm.After(ims)
+}
+
+// etagMatches uses the weak comparison of RFC 9110 section 8.8.3.2.
+func etagMatches(list, etag string) bool {
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || etag != "" && strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Fields of a 200 response also sent in a 304, RFC 9110 section 15.4.5.
+var notModifiedFields = []string{
+	"cache-control", "content-location", "date", "etag", "expires", "vary",
+	"age", "cache-status",
+}
+
+// notModifiedResponse returns the 304 response for |res|.
+func notModifiedResponse(res *Response) *Response {
+	headers := HTTPHeader{}
+	for _, k := range notModifiedFields {
+		if v, ok := res.Headers[k]; ok {
+			headers[k] = v
+		}
+	}
+	return &Response{res.Version, 304, "Not Modified", headers}
+}
+
+// cacheRevalidation is a stale response being validated with the server.
+type cacheRevalidation struct {
+	entry *cacheEntry
+	req   *Request          // as received from the client
+	body  io.ReadSeekCloser // nil for HEAD
+}
+
+// revalidate prepares validating |e|, which is stale, for |req|. It
+// returns nil if |e| has no validators.
+func (c *Cache) revalidate(req *Request, e *cacheEntry) (*cacheRevalidation, error) {
+	etag, lm := e.res.Headers["etag"], e.res.Headers["last-modified"]
+	if etag == "" && lm == "" {
+		return nil, nil
+	}
+	r := &cacheRevalidation{entry: e, req: copyRequest(req)}
+	if req.Method != "HEAD" {
+		// Opened now, so that the body outlives the entry if replaced.
+		body, err := e.openBody()
+		if err != nil {
+			return nil, err
+		}
+		r.body = body
+	}
+	return r, nil
+}
+
+// setConditions makes the request headers |h| conditional on the
+// validators of the stale response. Conditions of the client are
+// evaluated against the stored response instead.
+func (r *cacheRevalidation) setConditions(h HTTPHeader) {
+	delete(h, "if-none-match")
+	delete(h, "if-modified-since")
+	if etag := r.entry.res.Headers["etag"]; etag != "" {
+		h["if-none-match"] = etag
+	}
+	if lm := r.entry.res.Headers["last-modified"]; lm != "" {
+		h["if-modified-since"] = lm
+	}
+}
+
+// Fields of a 304 response not applied to the stored response, besides
+// hop-by-hop fields.
+var notUpdatedFields = map[string]bool{"content-length": true, "cache-status": true}
+
+// freshen updates the stored response with the 304 response |res|, RFC
+// 9111 section 4.3.4, and returns the response to serve. It returns nil if
+// |res| is about another representation.
+func (c *Cache) freshen(r *cacheRevalidation, res *Response, requestTime, responseTime time.Time) *cacheEntry {
+	e := r.entry
+	if etag := res.Headers["etag"]; etag != "" && !etagMatches(etag, e.res.Headers["etag"]) {
+		return nil
+	}
+	headers := make(HTTPHeader, len(e.res.Headers))
+	for k, v := range e.res.Headers {
+		headers[k] = v
+	}
+	// The age of the stored response is superseded by that of |res|.
+	delete(headers, "age")
+	updates := make(HTTPHeader, len(res.Headers))
+	for k, v := range res.Headers {
+		updates[k] = v
+	}
+	RemoveHopByHopHeaders(updates)
+	for k, v := range updates {
+		if !notUpdatedFields[k] {
+			headers[k] = v
+		}
+	}
+	updated := &Response{e.res.Version, e.res.Status, e.res.Phrase, headers}
+	f := &cacheEntry{
+		body:         e.body,
+		bodyFile:     e.bodyFile,
+		bodySize:     e.bodySize,
+		requestTime:  requestTime,
+		responseTime: responseTime,
+	}
+	if !c.add(r.req, updated, f) {
+		// Served once anyway.
+		f.res = updated
+		f.initialAge = initialAge(updated, requestTime, responseTime)
+		f.lifetime = freshnessLifetime(updated, parseCacheControl(headers["cache-control"]))
+	}
+	return f
+}
+
+// cacheFill collects a response to store once relayed.
+type cacheFill struct {
+	cache  *Cache
+	req    *Request // as received from the client
+	body   *cacheBody
+	w      io.Writer // body, or a decoder writing to it
+	failed bool
+}
+
+func (c *Cache) newFill(req *Request) *cacheFill {
+	body := &cacheBody{memLimit: c.maxMemObject, limit: c.maxObject, dir: c.spillDir}
+	return &cacheFill{cache: c, req: copyRequest(req), body: body, w: body}
+}
+
+func copyRequest(req *Request) *Request {
+	headers := make(HTTPHeader, len(req.Headers))
+	for k, v := range req.Headers {
+		headers[k] = v
+	}
+	return &Request{req.Method, req.URI, req.Version, headers}
+}
+
+// writer returns where to copy the body of |res| as relayed.
+func (f *cacheFill) writer(res *Response) io.Writer {
+	if isTransferEncodingChunked(res.Headers) {
+		f.w = NewChunkedDecoder(f.body)
+	}
+	return f
+}
+
+// Write never fails, so that relaying goes on if the body can't be kept.
+func (f *cacheFill) Write(b []byte) (int, error) {
+	if !f.failed {
+		if _, err := f.w.Write(b); err != nil {
+			f.failed = true
+		}
+	}
+	return len(b), nil
+}
+
+// store puts the relayed response |res| in the cache, or discards the
+// body.
+func (f *cacheFill) store(res *Response, requestTime, responseTime time.Time) bool {
+	if d, ok := f.w.(*ChunkedDecoder); f.failed || (ok && !d.Done()) {
+		f.body.discard()
+		return false
+	}
+	e, ok := f.body.finish()
+	if !ok {
+		return false
+	}
+	e.requestTime, e.responseTime = requestTime, responseTime
+	if !f.cache.add(f.req, res, e) {
+		if e.bodyFile != "" {
+			os.Remove(e.bodyFile)
+		}
+		return false
+	}
+	return true
+}
+
+// cacheBody keeps a decoded body in memory up to |memLimit| bytes, then in
+// a temporary file in |dir|.
+type cacheBody struct {
+	mu       sync.Mutex
+	memLimit int64
+	limit    int64
+	dir      string // empty to never spill
+	mem      []byte
+	file     *os.File
+	size     int64
+	done     bool // failed or finished
+}
+
+func (b *cacheBody) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return len(p), nil
+	}
+	if b.size += int64(len(p)); b.size > b.limit {
+		b.drop()
+		return len(p), nil
+	}
+	if b.file == nil && b.size > b.memLimit {
+		if b.dir == "" {
+			b.drop()
+			return len(p), nil
+		}
+		f, err := os.CreateTemp(b.dir, ".fill-*")
+		if err != nil {
+			logger.Warnf("cache: %v", err)
+			b.drop()
+			return len(p), nil
+		}
+		b.file = f
+		p = append(b.mem, p...)
+		b.mem = nil
+	}
+	if b.file == nil {
+		b.mem = append(b.mem, p...)
+	} else if _, err := b.file.Write(p); err != nil {
+		logger.Warnf("cache: %v", err)
+		b.drop()
+	}
+	return len(p), nil
+}
+
+func (b *cacheBody) drop() {
+	b.done = true
+	b.mem = nil
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file = nil
+	}
+}
+
+func (b *cacheBody) discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.drop()
+}
+
+// finish returns an entry with the body set. A body file is synced and
+// belongs to the entry.
+func (b *cacheBody) finish() (*cacheEntry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return nil, false
+	}
+	b.done = true
+	e := &cacheEntry{body: b.mem, bodySize: b.size}
+	if b.file == nil {
+		return e, true
+	}
+	f := b.file
+	b.file = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, false
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, false
+	}
+	e.bodyFile = f.Name()
+	return e, true
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var cacheEpoch = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// cacheResponse returns a 200 response with |headers| as "Name: value"
+// lines, dated |cacheEpoch|.
+func cacheResponse(headers ...string) *Response {
+	res := &Response{"HTTP/1.1", 200, "OK", HTTPHeader{
+		"date": cacheEpoch.Format(http.TimeFormat),
+	}}
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ":")
+		res.Headers[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+	return res
+}
+
+func cacheRequest(headers ...string) *Request {
+	req := &Request{"GET", "http://example.com/a", "HTTP/1.1", HTTPHeader{"host": "example.com"}}
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ":")
+		req.Headers[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+	return req
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	lastModified := cacheEpoch.Add(-100 * time.Hour).Format(http.TimeFormat)
+	for _, c := range []struct {
+		res  *Response
+		want string
+	}{
+		{cacheResponse("Cache-Control: max-age=60, s-maxage=30"), "30s"},
+		{cacheResponse("Cache-Control: max-age=60", "Expires: Thu, 01 Jan 1970 00:00:00 GMT"), "1m0s"},
+		{cacheResponse("Expires: " + cacheEpoch.Add(time.Hour).Format(http.TimeFormat)), "1h0m0s"},
+		{cacheResponse("Expires: 0"), "0s"},
+		{cacheResponse("Last-Modified: " + lastModified), "10h0m0s"},
+		{cacheResponse("Last-Modified: Thu, 01 Jan 1970 00:00:00 GMT"), "24h0m0s"},
+		{cacheResponse("Cache-Control: max-age=invalid"), "0s"},
+		{cacheResponse(), "0s"},
+	} {
+		got := freshnessLifetime(c.res, parseCacheControl(c.res.Headers["cache-control"]))
+		ExpectEqual(t, c.want, got.String())
+	}
+}
+
+func TestInitialAge(t *testing.T) {
+	sent := cacheEpoch.Add(10 * time.Second)
+	received := sent.Add(2 * time.Second)
+	ExpectEqual(t, "12s", initialAge(cacheResponse(), sent, received).String())
+	ExpectEqual(t, "1m2s", initialAge(cacheResponse("Age: 60"), sent, received).String())
+}
+
+func TestCacheLookup(t *testing.T) {
+	c := NewCache(newMemoryStore(1<<20), nil, 1<<20)
+	put := func(headers ...string) {
+		if !c.put(cacheRequest(), cacheResponse(headers...), []byte("body"), cacheEpoch, cacheEpoch) {
+			t.Fatalf("%v not stored", headers)
+		}
+	}
+	lookup := func(at time.Duration, headers ...string) string {
+		_, result := c.lookup(cacheRequest(headers...), cacheEpoch.Add(at))
+		return result
+	}
+
+	_, result := c.lookup(cacheRequest(), cacheEpoch)
+	ExpectEqual(t, CacheMiss, result)
+	put("Cache-Control: max-age=60")
+	ExpectEqual(t, CacheHit, lookup(59*time.Second))
+	ExpectEqual(t, CacheStale, lookup(61*time.Second))
+	ExpectEqual(t, CacheStale, lookup(20*time.Second, "Cache-Control: max-age=10"))
+	ExpectEqual(t, CacheStale, lookup(40*time.Second, "Cache-Control: min-fresh=30"))
+	ExpectEqual(t, CacheHit, lookup(70*time.Second, "Cache-Control: max-stale=30"))
+	ExpectEqual(t, CacheStale, lookup(100*time.Second, "Cache-Control: max-stale=30"))
+	ExpectEqual(t, CacheHit, lookup(time.Hour, "Cache-Control: max-stale"))
+	ExpectEqual(t, CacheBypass, lookup(0, "Cache-Control: no-cache"))
+	ExpectEqual(t, CacheBypass, lookup(0, "Pragma: no-cache"))
+
+	put("Cache-Control: max-age=60, must-revalidate")
+	ExpectEqual(t, CacheStale, lookup(70*time.Second, "Cache-Control: max-stale"))
+	put("Cache-Control: max-age=60, no-cache", `ETag: "v1"`)
+	ExpectEqual(t, CacheStale, lookup(0))
+	put("Cache-Control: max-age=60")
+
+	e, _ := c.lookup(cacheRequest(), cacheEpoch.Add(30*time.Second))
+	res := e.response(cacheEpoch.Add(30 * time.Second))
+	ExpectEqual(t, "30 proxy; hit 4", res.Headers["age"]+" "+res.Headers["cache-status"]+" "+
+		res.Headers["content-length"])
+
+	c.invalidate("http://example.com/a")
+	ExpectEqual(t, CacheMiss, lookup(0))
+}
+
+func TestCacheStorable(t *testing.T) {
+	c := NewCache(newMemoryStore(1<<20), nil, 10)
+	for _, tc := range []struct {
+		req  *Request
+		res  *Response
+		want bool
+	}{
+		{cacheRequest(), cacheResponse("Cache-Control: max-age=60"), true},
+		{cacheRequest(), cacheResponse(), false},
+		{cacheRequest(), cacheResponse("Cache-Control: no-store, max-age=60"), false},
+		{cacheRequest(), cacheResponse("Cache-Control: private, max-age=60"), false},
+		{cacheRequest("Cache-Control: no-store"), cacheResponse("Cache-Control: max-age=60"), false},
+		{cacheRequest("Authorization: Basic eDp5"), cacheResponse("Cache-Control: max-age=60"), false},
+		{cacheRequest("Authorization: Basic eDp5"), cacheResponse("Cache-Control: public, max-age=60"), true},
+		{cacheRequest(), cacheResponse("Cache-Control: max-age=60", "Set-Cookie: a=b"), false},
+		{cacheRequest(), cacheResponse("Cache-Control: max-age=60", "Vary: *"), false},
+		{cacheRequest(), cacheResponse("Cache-Control: max-age=60", "Content-Length: 3"), false},
+		{cacheRequest(), cacheResponse(`ETag: "v1"`), true},
+		{cacheRequest(), cacheResponse("Cache-Control: no-cache", "Last-Modified: "+cacheEpoch.Format(http.TimeFormat)), true},
+	} {
+		got := c.put(tc.req, tc.res, []byte("body"), cacheEpoch, cacheEpoch)
+		ExpectEqual(t, fmt.Sprint(tc.want), fmt.Sprint(got))
+	}
+	if c.put(cacheRequest(), cacheResponse("Cache-Control: max-age=60"), make([]byte, 11), cacheEpoch, cacheEpoch) {
+		t.Errorf("stored body over the limit")
+	}
+	partial := cacheResponse("Cache-Control: max-age=60")
+	partial.Status = 206
+	if c.put(cacheRequest(), partial, []byte("body"), cacheEpoch, cacheEpoch) {
+		t.Errorf("stored partial content")
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	c := NewCache(newMemoryStore(1<<20), nil, 1<<20)
+	for _, enc := range []string{"gzip", "br"} {
+		c.put(cacheRequest("Accept-Encoding: "+enc),
+			cacheResponse("Cache-Control: max-age=60", "Vary: Accept-Encoding"),
+			[]byte(enc), cacheEpoch, cacheEpoch)
+	}
+	for _, enc := range []string{"gzip", "br"} {
+		e, result := c.lookup(cacheRequest("Accept-Encoding: "+enc), cacheEpoch)
+		ExpectEqual(t, CacheHit, result)
+		ExpectEqual(t, enc, string(e.body))
+	}
+	_, result := c.lookup(cacheRequest("Accept-Encoding: identity"), cacheEpoch)
+	ExpectEqual(t, CacheMiss, result)
+
+	// A response varying on other fields starts over.
+	c.put(cacheRequest("Accept-Language: fr"),
+		cacheResponse("Cache-Control: max-age=60", "Vary: Accept-Language"),
+		[]byte("fr"), cacheEpoch, cacheEpoch)
+	_, result = c.lookup(cacheRequest("Accept-Encoding: gzip"), cacheEpoch)
+	ExpectEqual(t, CacheMiss, result)
+	_, result = c.lookup(cacheRequest("Accept-Language: fr"), cacheEpoch)
+	ExpectEqual(t, CacheHit, result)
+}
+
+func TestMemoryStoreLRU(t *testing.T) {
+	entry := func() *cacheEntry { return &cacheEntry{vary: []string{"x"}} }
+	s := newMemoryStore(3 * entry().size())
+	s.put("a", entry())
+	s.put("b", entry())
+	s.put("c", entry())
+	s.get("a")
+	s.put("d", entry())
+	var kept []string
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if s.get(k) != nil {
+			kept = append(kept, k)
+		}
+	}
+	ExpectEqual(t, "a c d", strings.Join(kept, " "))
+	s.remove("a")
+	ExpectEqual(t, fmt.Sprint(2*entry().size()), fmt.Sprint(s.size))
+}
+
+func TestWorkerCache(t *testing.T) {
+	defer func() { responseCache = nil }()
+	responseCache = NewCache(newMemoryStore(1<<20), nil, 1<<20)
+
+	var dials atomic.Int32
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		n := dials.Add(1)
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, c)
+		go fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\n"+
+			"Transfer-Encoding: chunked\r\n\r\n5\r\nbody%d\r\n0\r\n\r\n", n)
+		return s, nil
+	}
+	get := func(method string) string {
+		status, body := proxyOnPipe(t, method+" http://cached.example/x HTTP/1.1\r\n"+
+			"Host: cached.example\r\nContent-Length: 0\r\n\r\n")
+		return fmt.Sprint(status, " ", body)
+	}
+	ExpectEqual(t, "200 body1", get("GET"))
+	ExpectEqual(t, "200 body1", get("GET"))
+	ExpectEqual(t, "200 ", get("HEAD"))
+	ExpectEqual(t, "1", fmt.Sprint(dials.Load()))
+
+	ExpectEqual(t, "200 body2", get("POST"))
+	ExpectEqual(t, "200 body3", get("GET"))
+	ExpectEqual(t, "200 body3", get("GET"))
+	ExpectEqual(t, "3", fmt.Sprint(dials.Load()))
+
+	status, _ := proxyOnPipe(t, "GET http://other.example/ HTTP/1.1\r\n"+
+		"Host: other.example\r\nCache-Control: only-if-cached\r\n\r\n")
+	ExpectEqual(t, "504", fmt.Sprint(status))
+	ExpectEqual(t, "3", fmt.Sprint(dials.Load()))
+}
+
+func TestWorkerCacheHostMismatch(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	defer func() { responseCache = nil }()
+	responseCache = NewCache(newMemoryStore(1<<20), nil, 1<<20)
+
+	var dialed []string
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, c)
+		go fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\n"+
+			"Content-Length: 4\r\n\r\n%.4s", addr)
+		return s, nil
+	}
+	// The response of evil.example must not be cached as victim.example's.
+	status, _ := proxyOnPipe(t, "GET http://victim.example/app.js HTTP/1.1\r\n"+
+		"Host: evil.example\r\n\r\n")
+	ExpectEqual(t, "400", fmt.Sprint(status))
+	status, body := proxyOnPipe(t, "GET /app.js HTTP/1.1\r\nHost: victim.example\r\n\r\n")
+	ExpectEqual(t, "200 vict", fmt.Sprint(status, " ", body))
+	ExpectEqual(t, "[victim.example:80]", fmt.Sprint(dialed))
+
+	for _, target := range []string{"http://Victim.example:80/app.js", "http://victim.example/app.js"} {
+		status, _ = proxyOnPipe(t, "GET "+target+" HTTP/1.1\r\nHost: victim.example\r\n\r\n")
+		ExpectEqual(t, "200", fmt.Sprint(status))
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	res := cacheResponse(`ETag: W/"v1"`, "Last-Modified: "+cacheEpoch.Format(http.TimeFormat))
+	for _, c := range []struct {
+		header string
+		want   bool
+	}{
+		{`If-None-Match: "v1"`, true},
+		{`If-None-Match: "v0", W/"v1"`, true},
+		{`If-None-Match: *`, true},
+		{`If-None-Match: "v2"`, false},
+		{"If-Modified-Since: " + cacheEpoch.Format(http.TimeFormat), true},
+		{"If-Modified-Since: " + cacheEpoch.Add(-time.Second).Format(http.TimeFormat), false},
+		{"If-Modified-Since: invalid", false},
+		{"Accept: */*", false},
+	} {
+		got := notModified(cacheRequest(c.header).Headers, res)
+		ExpectEqual(t, c.header+" "+fmt.Sprint(c.want), c.header+" "+fmt.Sprint(got))
+	}
+	// If-None-Match takes precedence.
+	h := cacheRequest(`If-None-Match: "v2"`, "If-Modified-Since: "+cacheEpoch.Format(http.TimeFormat)).Headers
+	ExpectEqual(t, "false", fmt.Sprint(notModified(h, res)))
+
+	res = notModifiedResponse(cacheResponse(`ETag: "v1"`, "Content-Type: text/plain", "Content-Length: 4"))
+	ExpectEqual(t, `304 "v1"  `, fmt.Sprint(res.Status, " ", res.Headers["etag"], " ",
+		res.Headers["content-type"], " ", res.Headers["content-length"]))
+}
+
+func TestCacheFreshen(t *testing.T) {
+	c := NewCache(newMemoryStore(1<<20), nil, 1<<20)
+	c.put(cacheRequest(), cacheResponse("Cache-Control: max-age=60", `ETag: "v1"`, "Age: 100", "X-Version: 1"),
+		[]byte("body"), cacheEpoch, cacheEpoch)
+	e, result := c.lookup(cacheRequest(), cacheEpoch)
+	ExpectEqual(t, CacheStale, result)
+
+	req := cacheRequest(`If-None-Match: "v0"`)
+	r, err := c.revalidate(req, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.setConditions(req.Headers)
+	ExpectEqual(t, `"v1" "v0"`, req.Headers["if-none-match"]+" "+r.req.Headers["if-none-match"])
+
+	later := cacheEpoch.Add(time.Minute)
+	res := cacheResponse("Cache-Control: max-age=60", `ETag: "v1"`, "X-Version: 2", "Content-Length: 0")
+	res.Status, res.Headers["date"] = 304, later.Format(http.TimeFormat)
+	if f := c.freshen(r, res, later, later); f == nil {
+		t.Fatal("not freshened")
+	}
+	e, result = c.lookup(cacheRequest(), later.Add(time.Second))
+	ExpectEqual(t, CacheHit, result)
+	ExpectEqual(t, "2 4 body", e.res.Headers["x-version"]+" "+e.res.Headers["content-length"]+" "+string(e.body))
+
+	res.Headers["etag"] = `"v2"`
+	if c.freshen(r, res, later, later) != nil {
+		t.Errorf("freshened with another representation")
+	}
+}
+
+func TestWorkerRevalidation(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	defer func() { responseCache = nil }()
+	responseCache = NewCache(newMemoryStore(1<<20), nil, 1<<20)
+
+	var dials atomic.Int32
+	var conditions []string
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		n := dials.Add(1)
+		s, c := net.Pipe()
+		go func() {
+			req, err := http.ReadRequest(bufio.NewReader(c))
+			if err != nil {
+				return
+			}
+			conditions = append(conditions, req.Header.Get("If-None-Match"))
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				fmt.Fprintf(c, "HTTP/1.1 304 Not Modified\r\nCache-Control: max-age=60\r\n"+
+					"ETag: \"v1\"\r\nX-Fetch: %d\r\n\r\n", n)
+			} else {
+				// Stale from the start.
+				fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\nAge: 100\r\n"+
+					"ETag: \"v1\"\r\nX-Fetch: %d\r\nContent-Length: 4\r\n\r\nbody", n)
+			}
+			io.Copy(io.Discard, c)
+		}()
+		return s, nil
+	}
+	get := func(headers string) string {
+		res, body := proxyResponseOnPipe(t, "GET http://cached.example/x HTTP/1.1\r\n"+
+			"Host: cached.example\r\n"+headers+"\r\n")
+		return fmt.Sprint(res.StatusCode, " ", body, " ", res.Header.Get("X-Fetch"), " ",
+			res.Header.Get("Cache-Status"))
+	}
+	ExpectEqual(t, "200 body 1 ", get(""))
+	ExpectEqual(t, "200 body 2 proxy; fwd=stale; fwd-status=304", get(`If-None-Match: "v0"`+"\r\n"))
+	ExpectEqual(t, `[ "v1"]`, fmt.Sprint(conditions))
+
+	// Fresh again, and conditional requests are answered by the proxy.
+	ExpectEqual(t, "200 body 2 proxy; hit", get(""))
+	ExpectEqual(t, "304   proxy; hit", get(`If-None-Match: W/"v1"`+"\r\n"))
+	ExpectEqual(t, "2", fmt.Sprint(dials.Load()))
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"strconv"
 )
 
 func min(a, b int) int {
@@ -86,6 +88,114 @@ func (r *ChunkedReader) Read(b []byte) (int, error) {
 	return m, nil
 }
 
+// decodeBody removes the chunked framing of a body as relayed, if |h|
+// says it is chunked. A cut body decodes up to the cut.
+func decodeBody(b []byte, h HTTPHeader) []byte {
+	if !isTransferEncodingChunked(h) {
+		return b
+	}
+	d, _ := io.ReadAll(NewChunkedReader(bytes.NewReader(b)))
+	return d
+}
+
+// ChunkedDecoder writes the data of a chunked body written to it, in any
+// pieces, to another writer. Chunk extensions and trailers are dropped.
+type ChunkedDecoder struct {
+	w     io.Writer
+	line  []byte // partial chunk size or trailer line
+	left  int64  // data bytes left in the chunk
+	state int
+}
+
+// Longest chunk size or trailer line accepted by ChunkedDecoder.
+const maxChunkLine = 4096
+
+const (
+	chunkSize = iota
+	chunkData
+	chunkDataEnd // CRLF after the data
+	chunkTrailer
+	chunkDone
+)
+
+func NewChunkedDecoder(w io.Writer) *ChunkedDecoder {
+	return &ChunkedDecoder{w: w}
+}
+
+// Done reports whether the last chunk and the trailer were written.
+func (d *ChunkedDecoder) Done() bool {
+	return d.state == chunkDone
+}
+
+func (d *ChunkedDecoder) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		switch d.state {
+		case chunkData:
+			m := int(min64(d.left, int64(len(b))))
+			if _, err := d.w.Write(b[:m]); err != nil {
+				return n - len(b), err
+			}
+			b = b[m:]
+			if d.left -= int64(m); d.left == 0 {
+				d.state = chunkDataEnd
+			}
+		case chunkDone:
+			return n - len(b), fmt.Errorf("Data after the last chunk")
+		default:
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				if d.line = append(d.line, b...); len(d.line) > maxChunkLine {
+					return n, fmt.Errorf("Chunk line too long")
+				}
+				return n, nil
+			}
+			d.line = append(d.line, b[:i+1]...)
+			b = b[i+1:]
+			if err := d.endLine(); err != nil {
+				return n - len(b), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (d *ChunkedDecoder) endLine() error {
+	line, ok := bytes.CutSuffix(d.line, crlf)
+	d.line = d.line[:0]
+	if !ok {
+		return fmt.Errorf("Failed to read CRLF")
+	}
+	switch d.state {
+	case chunkSize:
+		size, _, _ := bytes.Cut(line, []byte(";"))
+		l, err := strconv.ParseInt(string(bytes.TrimSpace(size)), 16, 64)
+		if err != nil || l < 0 {
+			return fmt.Errorf("Invalid chunk length: %s", line)
+		}
+		if d.left, d.state = l, chunkData; l == 0 {
+			d.state = chunkTrailer
+		}
+	case chunkDataEnd:
+		if len(line) != 0 {
+			return fmt.Errorf("Failed to read CRLF")
+		}
+		d.state = chunkSize
+	case chunkTrailer:
+		if len(line) == 0 {
+			d.state = chunkDone
+		}
+	}
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 var crlf = []byte("\r\n")
 var closeBytes = []byte("0\r\n\r\n")
 
@@ -54,3 +54,27 @@ func TestChunkedWriter(t *testing.T) {
 	}
 	ExpectEqual(t, "d\r\nThisIsChunked\r\n18\r\nAllYourBaseAreBelongToUs\r\n0\r\n\r\n", actual)
 }
+
+func TestChunkedDecoder(t *testing.T) {
+	body := "d;ext=1\r\nThisIsChunked\r\n18\r\nAllYourBaseAreBelongToUs\r\n0\r\nX-Sum: 1\r\n\r\n"
+	buf := new(bytes.Buffer)
+	d := NewChunkedDecoder(buf)
+	for i := 0; i < len(body); i++ {
+		if d.Done() {
+			t.Fatalf("done at %d", i)
+		}
+		if _, err := d.Write([]byte{body[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !d.Done() {
+		t.Errorf("not done")
+	}
+	ExpectEqual(t, "ThisIsChunkedAllYourBaseAreBelongToUs", buf.String())
+
+	for _, invalid := range []string{"x\r\n", "3\r\nabcd\r\n", "0\r\n\r\nmore"} {
+		if _, err := NewChunkedDecoder(io.Discard).Write([]byte(invalid)); err == nil {
+			t.Errorf("%q: no error", invalid)
+		}
+	}
+}
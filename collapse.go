@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Collapsed forwarding: concurrent misses for a URL wait for the response
+// fetched by the first, and get its body as it arrives instead of each
+// dialing the server.
+
+var errFetchFailed = errors.New("Collapsed fetch failed")
+
+// Times a worker joins fetches failing before their response.
+const maxCollapseTries = 3
+
+// cacheFetch is a response being fetched on a cache miss, relayed to the
+// client of the worker fetching it and to the workers that joined. The
+// body is kept as relayed, in memory up to |memLimit| bytes then in a
+// temporary file, until no worker reads it.
+type cacheFetch struct {
+	cache    *Cache
+	key      string
+	req      *Request // as received from the client of the fetching worker
+	limit    int64
+	memLimit int64
+	dir      string
+	ready    chan struct{} // closed once the response is known or the fetch ended
+
+	mu        sync.Mutex
+	published bool
+	unshared  bool      // the response is not to be shared
+	res       *Response // as relayed, nil unless shared
+	mem       []byte
+	file      *os.File
+	size      int64
+	done      bool          // the body was relayed in full
+	err       error         // the body won't be
+	changed   chan struct{} // closed and replaced on any change
+	refs      int
+}
+
+// collapsible tells if |req| may share a fetch: a GET whose response
+// doesn't depend on conditions or ranges.
+func collapsible(req *Request) bool {
+	if req.Method != "GET" {
+		return false
+	}
+	for _, name := range []string{"range", "if-range", "if-none-match", "if-modified-since"} {
+		if _, ok := req.Headers[name]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// joinFetch returns the fetch of the URL of |req| in progress, or a new
+// one to be made by the caller if |leader|. Callers release it with
+// Cache.endFetch if |leader|, release otherwise.
+func (c *Cache) joinFetch(req *Request) (f *cacheFetch, leader bool) {
+	// The URL names the server dialed, see hostMatchesURI.
+	key := requestURL(req)
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+	if f, ok := c.fetches[key]; ok {
+		f.mu.Lock()
+		f.refs++
+		f.mu.Unlock()
+		return f, false
+	}
+	dir := c.spillDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	f = &cacheFetch{
+		cache:    c,
+		key:      key,
+		req:      copyRequest(req),
+		limit:    c.maxObject,
+		memLimit: c.maxMemObject,
+		dir:      dir,
+		ready:    make(chan struct{}),
+		changed:  make(chan struct{}),
+		refs:     1,
+	}
+	c.fetches[key] = f
+	return f, true
+}
+
+// endFetch ends |f| if its body wasn't relayed in full yet.
+func (c *Cache) endFetch(f *cacheFetch) {
+	// Workers retrying after a failure must not join |f| again.
+	c.fetchMu.Lock()
+	if c.fetches[f.key] == f {
+		delete(c.fetches, f.key)
+	}
+	c.fetchMu.Unlock()
+	f.end(false)
+	f.release()
+}
+
+// shareable tells if |res| to |req| may be relayed to other clients: a
+// complete response a shared cache may store. Its length must be known up
+// front, as followers can't be failed once sent the headers of a body
+// growing over the limit.
+func (c *Cache) shareable(req *Request, res *Response) bool {
+	if res.Status != 200 || isTransferEncodingChunked(res.Headers) {
+		return false
+	}
+	if cl, err := contentLength(res.Headers); err != nil || int64(cl) > c.maxObject {
+		return false
+	}
+	return c.storable(req, res, freshnessLifetime(res, parseCacheControl(res.Headers["cache-control"])))
+}
+
+// publish sets the response, nil if it is not to be shared.
+func (f *cacheFetch) publish(res *Response) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.published || f.err != nil {
+		return
+	}
+	f.published = true
+	f.res = res
+	f.unshared = res == nil
+	close(f.ready)
+	f.notify()
+}
+
+// Write appends to the body. It never fails, so that relaying to the
+// client of the fetching worker goes on.
+func (f *cacheFetch) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.res == nil || f.done || f.err != nil {
+		return len(p), nil
+	}
+	if f.size+int64(len(p)) > f.limit {
+		logger.Warnf("cache: %s: body over %d bytes, collapsed requests fail", f.key, f.limit)
+		f.fail()
+		return len(p), nil
+	}
+	if f.file == nil && f.size+int64(len(p)) > f.memLimit {
+		file, err := os.CreateTemp(f.dir, ".collapse-*")
+		if err == nil {
+			_, err = file.Write(f.mem)
+		}
+		if err != nil {
+			logger.Warnf("cache: %v", err)
+			if file != nil {
+				file.Close()
+				os.Remove(file.Name())
+			}
+			f.fail()
+			return len(p), nil
+		}
+		f.file = file
+		f.mem = nil
+	}
+	if f.file == nil {
+		f.mem = append(f.mem, p...)
+	} else if _, err := f.file.WriteAt(p, f.size); err != nil {
+		logger.Warnf("cache: %v", err)
+		f.fail()
+		return len(p), nil
+	}
+	f.size += int64(len(p))
+	f.notify()
+	return len(p), nil
+}
+
+// end marks the body relayed in full if |complete|, failed otherwise,
+// unless it already ended.
+func (f *cacheFetch) end(complete bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done || f.err != nil {
+		return
+	}
+	if !f.published {
+		f.published = true
+		close(f.ready)
+	}
+	if f.res != nil && complete {
+		// Bodies cut short end like complete ones.
+		if cl, _ := contentLength(f.res.Headers); int64(cl) == f.size {
+			f.done = true
+			f.notify()
+			return
+		}
+	}
+	f.fail()
+}
+
+func (f *cacheFetch) fail() {
+	f.err = errFetchFailed
+	f.notify()
+}
+
+func (f *cacheFetch) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *cacheFetch) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.refs--; f.refs == 0 && f.file != nil {
+		f.file.Close()
+		os.Remove(f.file.Name())
+		f.file = nil
+	}
+}
+
+// response returns the response to relay, once |ready| is closed. It is
+// nil if the fetch ended before a response, with |retry| true, or if the
+// response is not shared.
+func (f *cacheFetch) response() (res *Response, retry bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.res == nil {
+		return nil, !f.unshared
+	}
+	headers := make(HTTPHeader, len(f.res.Headers)+1)
+	for k, v := range f.res.Headers {
+		headers[k] = v
+	}
+	headers["cache-status"] = "proxy; fwd=miss; collapsed"
+	return &Response{f.res.Version, f.res.Status, f.res.Phrase, headers}, false
+}
+
+// sameVariant tells if the response to the fetch selected by its Vary
+// fields is also the one for |req|.
+func (f *cacheFetch) sameVariant(req *Request) bool {
+	for _, name := range strings.Split(f.res.Headers["vary"], ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && strings.Join(strings.Fields(f.req.Headers[name]), " ") !=
+			strings.Join(strings.Fields(req.Headers[name]), " ") {
+			return false
+		}
+	}
+	return true
+}
+
+// leaderWriter relays the body of a fetch to the client of the fetching
+// worker. Once writing to the client fails, the error is kept and writes are
+// dropped, so that the body still reaches the fetch for the workers that
+// joined.
+type leaderWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (l *leaderWriter) Write(p []byte) (int, error) {
+	if l.err == nil {
+		if n, err := l.w.Write(p); err != nil || n != len(p) {
+			if l.err = err; err == nil {
+				l.err = io.ErrShortWrite
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// newReader returns a reader of the body from its start, blocking for
+// what is yet to come. Reads fail once |done| is closed.
+func (f *cacheFetch) newReader(done <-chan struct{}) io.Reader {
+	return &fetchReader{f: f, done: done}
+}
+
+type fetchReader struct {
+	f    *cacheFetch
+	off  int64
+	done <-chan struct{}
+}
+
+func (r *fetchReader) Read(p []byte) (int, error) {
+	f := r.f
+	for {
+		f.mu.Lock()
+		if r.off < f.size {
+			var n int
+			var err error
+			if f.file != nil {
+				n, err = f.file.ReadAt(p[:min64(int64(len(p)), f.size-r.off)], r.off)
+			} else {
+				n = copy(p, f.mem[r.off:])
+			}
+			f.mu.Unlock()
+			r.off += int64(n)
+			return n, err
+		}
+		if f.done {
+			f.mu.Unlock()
+			return 0, io.EOF
+		}
+		if f.err != nil {
+			f.mu.Unlock()
+			return 0, f.err
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.done:
+			return 0, errors.New("Canceled")
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheFetch(t *testing.T) {
+	c := NewCache(newMemoryStore(1<<20), nil, 4)
+	c.spillDir = t.TempDir()
+	c.maxObject = 100
+	req := cacheRequest()
+	f, leader := c.joinFetch(req)
+	g, follower := c.joinFetch(req)
+	ExpectEqual(t, "true false true", fmt.Sprint(leader, " ", follower, " ", f == g))
+
+	f.publish(cacheResponse("Cache-Control: max-age=60", "Content-Length: 10"))
+	res, _ := g.response()
+	ExpectEqual(t, "proxy; fwd=miss; collapsed", res.Headers["cache-status"])
+	r := g.newReader(nil)
+	got := make(chan string)
+	go func() {
+		b, err := io.ReadAll(r)
+		got <- fmt.Sprint(string(b), " ", err)
+	}()
+	f.Write([]byte("0123"))
+	f.Write([]byte("456789")) // spilled
+	names, _ := os.ReadDir(c.spillDir)
+	ExpectEqual(t, "1", fmt.Sprint(len(names)))
+	f.end(true)
+	ExpectEqual(t, "0123456789 <nil>", <-got)
+
+	g.release()
+	c.endFetch(f)
+	names, _ = os.ReadDir(c.spillDir)
+	ExpectEqual(t, "0", fmt.Sprint(len(names)))
+	if _, leader := c.joinFetch(req); !leader {
+		t.Errorf("joined an ended fetch")
+	}
+}
+
+func TestCacheFetchFailure(t *testing.T) {
+	c := NewCache(newMemoryStore(1<<20), nil, 1<<20)
+	f, _ := c.joinFetch(cacheRequest())
+	f.publish(cacheResponse("Cache-Control: max-age=60", "Content-Length: 10"))
+	f.Write([]byte("01234"))
+	// The server closed before the end of the body.
+	f.end(true)
+	_, err := io.ReadAll(f.newReader(nil))
+	ExpectEqual(t, errFetchFailed.Error(), fmt.Sprint(err))
+	c.endFetch(f)
+
+	// Failing before a response lets followers retry, unlike a response not
+	// to be shared.
+	f, _ = c.joinFetch(cacheRequest("X: 1"))
+	c.endFetch(f)
+	_, retry := f.response()
+	ExpectEqual(t, "true", fmt.Sprint(retry))
+	f, _ = c.joinFetch(cacheRequest("X: 2"))
+	f.publish(nil)
+	_, retry = f.response()
+	ExpectEqual(t, "false", fmt.Sprint(retry))
+}
+
+// collapseClients sends |n| GET requests for one URL at once, starting the
+// server exchange only once all joined the fetch of the first, and returns
+// the statuses and bodies sorted.
+func collapseClients(t *testing.T, n int, start chan struct{}) []string {
+	results := make(chan string, n)
+	for i := 0; i < n; i++ {
+		client, finished := runWorkerOnPipe(Timeouts{})
+		go func() {
+			go io.WriteString(client, "GET http://collapse.example/a HTTP/1.1\r\nHost: collapse.example\r\n\r\n")
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var result string
+			res, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err == nil {
+				var body []byte
+				body, err = io.ReadAll(res.Body)
+				result = fmt.Sprint(res.StatusCode, " ", string(body))
+			}
+			if err != nil {
+				result = err.Error()
+			}
+			client.Close()
+			<-finished
+			results <- result
+		}()
+	}
+	waitJoined(n)
+	close(start)
+	var got []string
+	for i := 0; i < n; i++ {
+		got = append(got, <-results)
+	}
+	sort.Strings(got)
+	return got
+}
+
+// waitJoined waits for |n| workers to join the fetch of the URL requested
+// by collapseClients.
+func waitJoined(n int) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		responseCache.fetchMu.Lock()
+		f := responseCache.fetches["http://collapse.example/a"]
+		responseCache.fetchMu.Unlock()
+		joined := 0
+		if f != nil {
+			f.mu.Lock()
+			joined = f.refs
+			f.mu.Unlock()
+		}
+		if joined == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// collapseServer answers with |header|, then the body in two parts, chunked
+// if |chunked|.
+func collapseServer(dials *atomic.Int32, start chan struct{}, header string, chunked bool) {
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		dials.Add(1)
+		<-start
+		s, c := net.Pipe()
+		go func() {
+			if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+				return
+			}
+			if chunked {
+				io.WriteString(c, "HTTP/1.1 200 OK\r\n"+header+"Transfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n")
+				time.Sleep(10 * time.Millisecond)
+				io.WriteString(c, "1\r\n!\r\n0\r\n\r\n")
+			} else {
+				io.WriteString(c, "HTTP/1.1 200 OK\r\n"+header+"Content-Length: 5\r\n\r\nbody")
+				time.Sleep(10 * time.Millisecond)
+				io.WriteString(c, "!")
+			}
+			io.Copy(io.Discard, c)
+		}()
+		return s, nil
+	}
+}
+
+func TestWorkerCollapse(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	defer func() { responseCache = nil }()
+	responseCache = NewCache(newMemoryStore(1<<20), nil, 1<<20)
+
+	var dials atomic.Int32
+	start := make(chan struct{})
+	collapseServer(&dials, start, "Cache-Control: max-age=60\r\n", false)
+	got := collapseClients(t, 5, start)
+	ExpectEqual(t, strings.Repeat("200 body!|", 5), strings.Join(got, "|")+"|")
+	ExpectEqual(t, "1", fmt.Sprint(dials.Load()))
+}
+
+func TestWorkerCollapseUnshareable(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	defer func() { responseCache = nil }()
+	responseCache = NewCache(newMemoryStore(1<<20), nil, 1<<20)
+
+	// Waiting clients make their own requests.
+	var dials atomic.Int32
+	start := make(chan struct{})
+	collapseServer(&dials, start, "Cache-Control: private, max-age=60\r\n", false)
+	got := collapseClients(t, 3, start)
+	ExpectEqual(t, strings.Repeat("200 body!|", 3), strings.Join(got, "|")+"|")
+	ExpectEqual(t, "3", fmt.Sprint(dials.Load()))
+
+	// A chunked body may grow over the limit after followers got headers.
+	responseCache = NewCache(newMemoryStore(1<<20), nil, 1<<20)
+	dials.Store(0)
+	start = make(chan struct{})
+	collapseServer(&dials, start, "Cache-Control: max-age=60\r\n", true)
+	got = collapseClients(t, 3, start)
+	ExpectEqual(t, strings.Repeat("200 body!|", 3), strings.Join(got, "|")+"|")
+	ExpectEqual(t, "3", fmt.Sprint(dials.Load()))
+}
+
+func TestWorkerCollapseHostMismatch(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	defer func() { responseCache = nil }()
+	responseCache = NewCache(newMemoryStore(1<<20), nil, 1<<20)
+
+	// A request to evil.example doesn't get the body fetched for example.com.
+	var dials atomic.Int32
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		dials.Add(1)
+		return nil, fmt.Errorf("Connection refused")
+	}
+	f, _ := responseCache.joinFetch(cacheRequest())
+	defer responseCache.endFetch(f)
+	status, _ := proxyOnPipe(t, "GET http://example.com/a HTTP/1.1\r\nHost: evil.example\r\n\r\n")
+	f.mu.Lock()
+	refs := f.refs
+	f.mu.Unlock()
+	ExpectEqual(t, "400 1 0", fmt.Sprint(status, " ", refs, " ", dials.Load()))
+}
+
+func TestWorkerCollapseLeaderFailure(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	defer func() { responseCache = nil }()
+	responseCache = NewCache(newMemoryStore(1<<20), nil, 1<<20)
+
+	// The first dial fails, and one of the waiting clients fetches for the
+	// others.
+	var dials atomic.Int32
+	start := make(chan struct{})
+	collapseServer(&dials, start, "Cache-Control: max-age=60\r\n", false)
+	next := serverDialer
+	var failed atomic.Bool
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		if failed.CompareAndSwap(false, true) {
+			<-start
+			return nil, fmt.Errorf("Connection refused")
+		}
+		return next(addr, timeout)
+	}
+	got := collapseClients(t, 3, start)
+	ExpectEqual(t, "200 body!|200 body!|400 ", strings.Join(got, "|"))
+	ExpectEqual(t, "1", fmt.Sprint(dials.Load()))
+}
+
+func TestWorkerCollapseLeaderDisconnect(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	defer func() { responseCache = nil }()
+	responseCache = NewCache(newMemoryStore(1<<20), nil, 1<<20)
+
+	// The client of the fetching worker leaves in the middle of the body,
+	// which still reaches the waiting client.
+	var dials atomic.Int32
+	start, leaderGone := make(chan struct{}), make(chan struct{})
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		dials.Add(1)
+		<-start
+		s, c := net.Pipe()
+		go func() {
+			if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+				return
+			}
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\nContent-Length: 5\r\n\r\nbody")
+			<-leaderGone
+			io.WriteString(c, "!")
+			io.Copy(io.Discard, c)
+		}()
+		return s, nil
+	}
+	get := "GET http://collapse.example/a HTTP/1.1\r\nHost: collapse.example\r\n\r\n"
+	leader, leaderFinished := runWorkerOnPipe(Timeouts{})
+	go io.WriteString(leader, get)
+	waitJoined(1)
+	follower, followerFinished := runWorkerOnPipe(Timeouts{})
+	go io.WriteString(follower, get)
+	waitJoined(2)
+	close(start)
+
+	leader.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(leader), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadFull(res.Body, make([]byte, 4))
+	leader.Close()
+	close(leaderGone)
+
+	follower.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if res, err = http.ReadResponse(bufio.NewReader(follower), nil); err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	ExpectEqual(t, "200 body! <nil>", fmt.Sprint(res.StatusCode, " ", string(body), " ", err))
+	follower.Close()
+	<-followerFinished
+	<-leaderFinished
+	ExpectEqual(t, "1", fmt.Sprint(dials.Load()))
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Settings is the configuration used by workers. A worker keeps the
+// Settings installed when it was created, so reloading the configuration
+// never changes the rules in the middle of a request.
+type Settings struct {
+	HeaderLimits HeaderLimits
+	Timeouts     Timeouts
+	ConnLimits   ConnLimits
+	ACL          *ACL
+	Guard        *DestinationGuard
+	Routes       []Route
+	Auth         Authenticator // nil if authentication is disabled
+	Blocklist    *Blocklist
+	// Host patterns, as in ACLRule.Hosts, whose requests log debug lines
+	// regardless of the log level.
+	DebugHosts []string
+}
+
+// Route sends requests for matching hosts through an upstream proxy.
+type Route struct {
+	Hosts []string // patterns as in ACLRule.Hosts
+	Via   string   // host:port of the upstream proxy
+}
+
+func (s *Settings) debugHost(host string) bool {
+	for _, p := range s.DebugHosts {
+		if matchHostPattern(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Settings) routeFor(host string) *Route {
+	for i, r := range s.Routes {
+		for _, p := range r.Hosts {
+			if matchHostPattern(p, host) {
+				return &s.Routes[i]
+			}
+		}
+	}
+	return nil
+}
+
+var installedSettings atomic.Pointer[Settings]
+
+// loadSettings returns the installed settings, or settings made from the
+// flags if none were installed.
+func loadSettings() *Settings {
+	if s := installedSettings.Load(); s != nil {
+		return s
+	}
+	return flagSettings()
+}
+
+func flagSettings() *Settings {
+	return &Settings{
+		HeaderLimits: headerLimits,
+		Timeouts:     timeouts,
+		ConnLimits:   connLimits,
+		ACL:          accessControl,
+		Guard:        destinationGuard,
+		Auth:         proxyAuth,
+		Blocklist:    blocklist,
+		DebugHosts:   debugHosts,
+	}
+}
+
+// duration is a time.Duration written as a string such as "1m30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Duration must be a string such as \"30s\": %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("Negative duration: %s", s)
+	}
+	*d = duration(v)
+	return nil
+}
+
+// Config is the content of a -config file, in JSON. Omitted values keep
+// the value given by flags. Lists given in the file replace the flags.
+type Config struct {
+	Listen []string `json:"listen"` // host:port, only read at startup
+	// As -metrics-addr, only read at startup.
+	MetricsListen string `json:"metrics_listen"`
+	// As -admin-addr, only read at startup.
+	AdminListen string         `json:"admin_listen"`
+	Logging     loggingConfig  `json:"logging"`
+	Timeouts    timeoutsConfig `json:"timeouts"`
+	Limits      limitsConfig   `json:"limits"`
+	ACL         aclConfig      `json:"acl"`
+	Routes      []routeConfig  `json:"routes"`
+}
+
+type loggingConfig struct {
+	Output       string   `json:"output"`        // "stderr", "stdout" or a file to append to
+	AccessLog    string   `json:"access_log"`    // as -access-log
+	AccessFormat string   `json:"access_format"` // as -access-log-format
+	Level        string   `json:"level"`         // as -log-level, kept if empty
+	DebugHosts   []string `json:"debug_hosts"`   // as -debug-host
+}
+
+type timeoutsConfig struct {
+	Dial      *duration `json:"dial"`
+	Header    *duration `json:"header"`
+	FirstByte *duration `json:"first_byte"`
+	Idle      *duration `json:"idle"`
+	Request   *duration `json:"request"`
+}
+
+type limitsConfig struct {
+	MaxRequestLine    *int      `json:"max_request_line"`
+	MaxHeaderField    *int      `json:"max_header_field"`
+	MaxHeaderBytes    *int      `json:"max_header_bytes"`
+	MaxHeaderCount    *int      `json:"max_header_count"`
+	MaxConns          *int      `json:"max_conns"`
+	MaxConnsPerClient *int      `json:"max_conns_per_client"`
+	ConnQueueTimeout  *duration `json:"conn_queue_timeout"`
+	RetryAfter        *duration `json:"retry_after"`
+	Rate              []string  `json:"rate"` // as -rate-limit
+}
+
+type aclConfig struct {
+	Default     string   `json:"default"`      // as -acl-default
+	Rules       []string `json:"rules"`        // as -acl
+	BlockRanges []string `json:"block_ranges"` // as -block-range
+	BlockExempt []string `json:"block_exempt"` // as -block-exempt
+}
+
+type routeConfig struct {
+	Hosts []string `json:"hosts"`
+	Via   string   `json:"via"`
+}
+
+// LoadConfig reads |path| and checks that it only contains known fields.
+// The values are validated by Config.settings.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	c := &Config{}
+	if err := d.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if d.More() {
+		return nil, fmt.Errorf("%s: Unexpected data after configuration", path)
+	}
+	for _, addr := range append(c.Listen, c.MetricsListen, c.AdminListen) {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("Invalid listen address: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func setDuration(dst *time.Duration, d *duration) {
+	if d != nil {
+		*dst = time.Duration(*d)
+	}
+}
+
+// setInt sets |dst| to |v| if given. |min| is the smallest valid value.
+func setInt(dst *int, v *int, name string, min int) error {
+	if v == nil {
+		return nil
+	}
+	if *v < min {
+		return fmt.Errorf("%s must be at least %d", name, min)
+	}
+	*dst = *v
+	return nil
+}
+
+// settings returns a copy of |base| changed by c.
+func (c *Config) settings(base *Settings) (*Settings, error) {
+	s := *base
+
+	t := c.Timeouts
+	setDuration(&s.Timeouts.Dial, t.Dial)
+	setDuration(&s.Timeouts.ClientHeader, t.Header)
+	setDuration(&s.Timeouts.FirstByte, t.FirstByte)
+	setDuration(&s.Timeouts.BodyIdle, t.Idle)
+	setDuration(&s.Timeouts.Total, t.Request)
+
+	l := c.Limits
+	for _, v := range []struct {
+		dst  *int
+		v    *int
+		name string
+		min  int
+	}{
+		{&s.HeaderLimits.MaxLineLength, l.MaxRequestLine, "max_request_line", 1},
+		{&s.HeaderLimits.MaxFieldLength, l.MaxHeaderField, "max_header_field", 1},
+		{&s.HeaderLimits.MaxHeaderBytes, l.MaxHeaderBytes, "max_header_bytes", 1},
+		{&s.HeaderLimits.MaxFieldCount, l.MaxHeaderCount, "max_header_count", 1},
+		{&s.ConnLimits.MaxTotal, l.MaxConns, "max_conns", 0},
+		{&s.ConnLimits.MaxPerClient, l.MaxConnsPerClient, "max_conns_per_client", 0},
+	} {
+		if err := setInt(v.dst, v.v, v.name, v.min); err != nil {
+			return nil, err
+		}
+	}
+	setDuration(&s.ConnLimits.QueueTimeout, l.ConnQueueTimeout)
+	setDuration(&s.ConnLimits.RetryAfter, l.RetryAfter)
+
+	if c.ACL.Rules != nil || c.ACL.Default != "" {
+		acl := *base.ACL
+		if c.ACL.Rules != nil {
+			acl.Rules = nil
+			for i, rs := range c.ACL.Rules {
+				r, err := ParseACLRule(fmt.Sprintf("acl.rules[%d]", i), rs)
+				if err != nil {
+					return nil, err
+				}
+				acl.Rules = append(acl.Rules, r)
+			}
+		}
+		if c.ACL.Default != "" {
+			if err := (aclDefaultFlag{&acl}).Set(c.ACL.Default); err != nil {
+				return nil, err
+			}
+		}
+		s.ACL = &acl
+	}
+
+	if c.ACL.BlockRanges != nil || c.ACL.BlockExempt != nil {
+		guard := *base.Guard
+		if c.ACL.BlockRanges != nil {
+			guard.Blocked = nil
+			for _, r := range c.ACL.BlockRanges {
+				if err := (blockRangeFlag{&guard}).Set(r); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if c.ACL.BlockExempt != nil {
+			guard.Exempt = c.ACL.BlockExempt
+		}
+		s.Guard = &guard
+	}
+
+	if c.Logging.DebugHosts != nil {
+		s.DebugHosts = c.Logging.DebugHosts
+	}
+
+	if c.Routes != nil {
+		s.Routes = nil
+		for i, r := range c.Routes {
+			if len(r.Hosts) == 0 {
+				return nil, fmt.Errorf("routes[%d] has no hosts", i)
+			}
+			if _, _, err := net.SplitHostPort(r.Via); err != nil {
+				return nil, fmt.Errorf("routes[%d]: Invalid via: %w", i, err)
+			}
+			s.Routes = append(s.Routes, Route{Hosts: r.Hosts, Via: r.Via})
+		}
+	}
+	return &s, nil
+}
+
+// rates returns |base| with the rate limits of c added.
+func (c *Config) rates(base rateConfig) (rateConfig, error) {
+	r := rateConfig{
+		defaults:  make(map[RateScope]RateLimit),
+		overrides: make(map[bucketKey]RateLimit),
+	}
+	for k, l := range base.defaults {
+		r.defaults[k] = l
+	}
+	for k, l := range base.overrides {
+		r.overrides[k] = l
+	}
+	for _, s := range c.Limits.Rate {
+		if err := r.add(s); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// openLogOutput returns the writer for |output| and a closer, nil for
+// stderr and stdout.
+func openLogOutput(output string) (io.Writer, io.Closer, error) {
+	switch output {
+	case "", "stderr":
+		return os.Stderr, nil, nil
+	case "stdout":
+		return os.Stdout, nil, nil
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f, nil
+}
+
+// configFile installs the settings of a -config file on top of those
+// given by flags. A reload either installs everything or nothing.
+type configFile struct {
+	file      watchedFile
+	base      *Settings
+	baseRates rateConfig
+	// -access-log and -access-log-format
+	baseAccessLog    string
+	baseAccessFormat string
+	listen           []string
+	mu               sync.Mutex
+	logFile          io.Closer // nil when logging to stderr or stdout
+	// Called with newly installed settings, e.g. to update a Server.
+	installed func(*Settings)
+}
+
+// newConfigFile loads |path| and installs it. The flags must be parsed
+// before.
+func newConfigFile(path string) (*configFile, *Config, error) {
+	f := &configFile{
+		file:             watchedFile{path: path},
+		base:             flagSettings(),
+		baseRates:        rateLimits.config(),
+		baseAccessLog:    *accessLogPath,
+		baseAccessFormat: *accessLogFormat,
+	}
+	c, err := f.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	f.listen = c.Listen
+	return f, c, nil
+}
+
+// Reload installs the configuration again. On failure the previous
+// settings stay installed and the error says why.
+func (f *configFile) Reload() error {
+	c, err := f.load()
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(c.Listen, f.listen) {
+		logger.Warnf("config: listen addresses changed, restart to apply")
+	}
+	return nil
+}
+
+func (f *configFile) load() (*Config, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.file.loaded(); err != nil {
+		return nil, err
+	}
+	c, err := LoadConfig(f.file.path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.settings(f.base)
+	if err != nil {
+		return nil, err
+	}
+	rates, err := c.rates(f.baseRates)
+	if err != nil {
+		return nil, err
+	}
+	accessOutput, accessFormat := f.baseAccessLog, f.baseAccessFormat
+	if c.Logging.AccessLog != "" {
+		accessOutput = c.Logging.AccessLog
+	}
+	if c.Logging.AccessFormat != "" {
+		accessFormat = c.Logging.AccessFormat
+	}
+	format, err := parseAccessLogFormat(accessFormat)
+	if err != nil {
+		return nil, err
+	}
+	level := currentLogLevel()
+	if c.Logging.Level != "" {
+		if level, err = parseLogLevel(c.Logging.Level); err != nil {
+			return nil, err
+		}
+	}
+	out, closer, err := openLogOutput(c.Logging.Output)
+	if err != nil {
+		return nil, err
+	}
+	accessOut, accessCloser, err := openAccessLogOutput(accessOutput)
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, err
+	}
+
+	log.SetOutput(out)
+	SetLogLevel(level)
+	accessLog.set(accessOut, accessCloser, format)
+	if f.logFile != nil {
+		f.logFile.Close()
+	}
+	f.logFile = closer
+	rateLimits.Configure(rates)
+	installedSettings.Store(s)
+	if f.installed != nil {
+		f.installed(s)
+	}
+	logger.Infof("config: installed %s", f.file.path)
+	return c, nil
+}
+
+// watch reloads the file when it changes until |done| is closed.
+func (f *configFile) watch(interval time.Duration, done <-chan struct{}) {
+	pollFiles([]*watchedFile{&f.file}, interval, done, f.Reload)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `{
+	"listen": ["127.0.0.1:0"],
+	"timeouts": {"dial": "3s", "idle": "1m30s"},
+	"limits": {"max_header_count": 10, "max_conns": 50, "rate": ["client=1m"]},
+	"acl": {"default": "deny", "rules": ["allow port=80,443"], "block_ranges": ["127.0.0.0/8"]},
+	"routes": [{"hosts": [".corp.example.com"], "via": "parent:3128"}]
+}`
+
+func TestConfigSettings(t *testing.T) {
+	c, err := LoadConfig(writeTempFile(t, "proxy.json", testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := c.settings(&Settings{
+		HeaderLimits: DefaultHeaderLimits,
+		Timeouts:     DefaultTimeouts,
+		ConnLimits:   DefaultConnLimits,
+		ACL:          &ACL{},
+		Guard:        &DestinationGuard{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "3s", s.Timeouts.Dial.String())
+	ExpectEqual(t, "1m30s", s.Timeouts.BodyIdle.String())
+	ExpectEqual(t, DefaultTimeouts.FirstByte.String(), s.Timeouts.FirstByte.String())
+	ExpectEqual(t, "{8192 8192 65536 10}", fmt.Sprint(s.HeaderLimits))
+	ExpectEqual(t, "50", fmt.Sprint(s.ConnLimits.MaxTotal))
+	if s.ACL.Default != ACLDeny || len(s.ACL.Rules) != 1 {
+		t.Errorf("unexpected ACL: %+v", s.ACL)
+	}
+	ExpectEqual(t, "[127.0.0.0/8]", fmt.Sprint(s.Guard.Blocked))
+	ExpectEqual(t, "parent:3128", s.routeFor("git.corp.example.com").Via)
+	if s.routeFor("example.com") != nil {
+		t.Errorf("unexpected route for example.com")
+	}
+
+	rates, err := c.rates(newRateLimiter().config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "1000000", fmt.Sprint(rates.defaults[RateScopeClient].BytesPerSec))
+}
+
+func TestConfigInvalid(t *testing.T) {
+	for _, s := range []string{
+		`{"timeout": {}}`,
+		`{"timeouts": {"dial": 10}}`,
+		`{"timeouts": {"dial": "-1s"}}`,
+		`{"listen": ["8080"]}`,
+		`{"limits": {"max_header_bytes": 0}}`,
+		`{"limits": {"rate": ["everyone=1m"]}}`,
+		`{"acl": {"rules": ["permit port=80"]}}`,
+		`{"acl": {"default": "maybe"}}`,
+		`{"acl": {"block_ranges": ["10.0.0.0/33"]}}`,
+		`{"routes": [{"hosts": ["a.example.com"], "via": "parent"}]}`,
+		`{"routes": [{"via": "parent:3128"}]}`,
+		`{} {}`,
+	} {
+		c, err := LoadConfig(writeTempFile(t, "proxy.json", s))
+		if err == nil {
+			_, err = c.settings(flagSettings())
+		}
+		if err == nil {
+			_, err = c.rates(newRateLimiter().config())
+		}
+		if err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	defer installedSettings.Store(nil)
+	saved := rateLimits.config()
+	defer rateLimits.Configure(saved)
+
+	path := writeTempFile(t, "proxy.json", `{"timeouts": {"dial": "1s"}}`)
+	f, _, err := newConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var installed *Settings
+	f.installed = func(s *Settings) { installed = s }
+	old := loadSettings()
+	ExpectEqual(t, "1s", old.Timeouts.Dial.String())
+	w := NewWorker()
+
+	os.WriteFile(path, []byte(`{"timeouts": {"dial": "forever"}}`), 0600)
+	if err := f.Reload(); err == nil {
+		t.Errorf("expected reload to fail")
+	}
+	if loadSettings() != old || installed != nil {
+		t.Errorf("failed reload replaced settings")
+	}
+
+	os.WriteFile(path, []byte(`{"timeouts": {"dial": "2s"}, "limits": {"rate": ["host=10k"]}}`), 0600)
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "2s", loadSettings().Timeouts.Dial.String())
+	if installed != loadSettings() {
+		t.Errorf("installed callback not called")
+	}
+	ExpectEqual(t, "10000", fmt.Sprint(rateLimits.config().defaults[RateScopeHost].BytesPerSec))
+	// Workers keep the settings they were created with.
+	ExpectEqual(t, "1s", w.settings.Timeouts.Dial.String())
+}
+
+func TestWorkerRoute(t *testing.T) {
+	defer installedSettings.Store(nil)
+	s := flagSettings()
+	s.Routes = []Route{{Hosts: []string{".corp.example.com"}, Via: "parent:3128"}}
+	installedSettings.Store(s)
+
+	var dialedAddr string
+	var forwarded string
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		dialedAddr = addr
+		srv, c := net.Pipe()
+		go func() {
+			r := bufio.NewReader(c)
+			for {
+				line, err := r.ReadString('\n')
+				forwarded += line
+				if err != nil || line == "\r\n" {
+					break
+				}
+			}
+			c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			c.Close()
+		}()
+		return srv, nil
+	}
+	w := NewWorker()
+	client, conn := net.Pipe()
+	finished := make(chan struct{})
+	go func() {
+		w.Start(conn)
+		close(finished)
+	}()
+	client.Write([]byte("CONNECT git.corp.example.com:443 HTTP/1.1\r\n" +
+		"Host: git.corp.example.com:443\r\nProxy-Authorization: Basic eA==\r\n\r\n"))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	b, _ := io.ReadAll(client)
+	client.Close()
+	<-finished
+	ExpectEqual(t, "parent:3128", dialedAddr)
+	if !strings.HasPrefix(forwarded, "CONNECT git.corp.example.com:443 HTTP/1.1\r\n") ||
+		strings.Contains(strings.ToLower(forwarded), "proxy-authorization") {
+		t.Errorf("unexpected request to upstream: %q", forwarded)
+	}
+	ExpectEqual(t, "HTTP/1.1 200 Connection established\r\n\r\n", string(b))
+}
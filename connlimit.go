@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnLimits bounds the number of concurrent workers. Zero means no limit.
+type ConnLimits struct {
+	MaxTotal     int
+	MaxPerClient int
+	// How long an excess connection waits for a free slot. If zero, it is
+	// refused immediately.
+	QueueTimeout time.Duration
+	// Sent in Retry-After of a 503 when a connection is refused.
+	RetryAfter time.Duration
+}
+
+var DefaultConnLimits = ConnLimits{
+	MaxTotal:     0,
+	MaxPerClient: 0,
+	QueueTimeout: 0,
+	RetryAfter:   5 * time.Second,
+}
+
+// Used by servers created from now on. Can be overridden by flags.
+var connLimits = DefaultConnLimits
+
+type errConnLimit struct {
+	perClient bool
+}
+
+func (e errConnLimit) Error() string {
+	if e.perClient {
+		return "Per-client connection limit reached"
+	}
+	return "Connection limit reached"
+}
+
+// limit is the label of the limit in Metrics.ConnLimitEvents.
+func (e errConnLimit) limit() string {
+	if e.perClient {
+		return "client"
+	}
+	return "total"
+}
+
+// ConnLimiterStats counts how often each limit triggered.
+type ConnLimiterStats struct {
+	TotalLimitHits  uint64 `json:"total_limit_hits"`  // a connection found the global limit reached
+	ClientLimitHits uint64 `json:"client_limit_hits"` // a connection found its client's limit reached
+	Queued          uint64 `json:"queued"`            // connections that had to wait for a slot
+	Rejected        uint64 `json:"rejected"`          // connections refused with 503
+}
+
+func (s ConnLimiterStats) String() string {
+	return fmt.Sprintf("total limit hits=%d, client limit hits=%d, queued=%d, rejected=%d",
+		s.TotalLimitHits, s.ClientLimitHits, s.Queued, s.Rejected)
+}
+
+type connLimiter struct {
+	limits    ConnLimits
+	mu        sync.Mutex
+	total     int
+	perClient map[string]int
+	released  chan struct{} // closed and replaced on every release
+
+	totalLimitHits  atomic.Uint64
+	clientLimitHits atomic.Uint64
+	queued          atomic.Uint64
+	rejected        atomic.Uint64
+}
+
+func newConnLimiter(limits ConnLimits) *connLimiter {
+	return &connLimiter{
+		limits:    limits,
+		perClient: make(map[string]int),
+		released:  make(chan struct{}),
+	}
+}
+
+// tryAcquire takes a slot for |client| if available. Otherwise it returns
+// the error describing which limit was hit and a channel that is closed
+// when any slot is released.
+func (l *connLimiter) tryAcquire(client string) (<-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.MaxTotal > 0 && l.total >= l.limits.MaxTotal {
+		return l.released, errConnLimit{false}
+	}
+	if l.limits.MaxPerClient > 0 && l.perClient[client] >= l.limits.MaxPerClient {
+		return l.released, errConnLimit{true}
+	}
+	l.total++
+	l.perClient[client]++
+	return nil, nil
+}
+
+func (l *connLimiter) countHit(err error) {
+	if err.(errConnLimit).perClient {
+		l.clientLimitHits.Add(1)
+	} else {
+		l.totalLimitHits.Add(1)
+	}
+}
+
+// acquire waits up to QueueTimeout for a slot. Every successful acquire
+// must be followed by release.
+func (l *connLimiter) acquire(client string) error {
+	released, err := l.tryAcquire(client)
+	if err == nil {
+		return nil
+	}
+	l.countHit(err)
+	wait := l.currentLimits().QueueTimeout
+	if wait <= 0 {
+		l.reject(err)
+		return err
+	}
+
+	l.queued.Add(1)
+	metrics.ConnLimitEvents.inc(err.(errConnLimit).limit(), "queued")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-released:
+		case <-timer.C:
+			l.reject(err)
+			return err
+		}
+		if released, err = l.tryAcquire(client); err == nil {
+			return nil
+		}
+	}
+}
+
+func (l *connLimiter) reject(err error) {
+	l.rejected.Add(1)
+	metrics.ConnLimitEvents.inc(err.(errConnLimit).limit(), "rejected")
+}
+
+func (l *connLimiter) currentLimits() ConnLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits
+}
+
+// setLimits changes the limits. Connections over a lowered limit are not
+// closed, and queued connections retry at once.
+func (l *connLimiter) setLimits(limits ConnLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+func (l *connLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perClient[client]--; l.perClient[client] <= 0 {
+		delete(l.perClient, client)
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+func (l *connLimiter) stats() ConnLimiterStats {
+	return ConnLimiterStats{
+		TotalLimitHits:  l.totalLimitHits.Load(),
+		ClientLimitHits: l.clientLimitHits.Load(),
+		Queued:          l.queued.Load(),
+		Rejected:        l.rejected.Load(),
+	}
+}
+
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func serviceUnavailableResponse(retryAfter time.Duration) *Response {
+	secs := int((retryAfter + time.Second - 1) / time.Second)
+	return &Response{
+		Version: "HTTP/1.1",
+		Status:  503,
+		Phrase:  "Service Unavailable",
+		Headers: HTTPHeader{
+			"retry-after":    strconv.Itoa(secs),
+			"content-length": "0",
+			"connection":     "close",
+		},
+	}
+}
+
+func refuseConn(conn net.Conn, err error, retryAfter time.Duration) {
+	logger.Warnf("refusing %v: %v", conn.RemoteAddr(), err)
+	WriteResponse(conn, serviceUnavailableResponse(retryAfter))
+	conn.Close()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnLimiterTotal(t *testing.T) {
+	l := newConnLimiter(ConnLimits{MaxTotal: 2})
+	if l.acquire("a") != nil || l.acquire("b") != nil {
+		t.Fatalf("acquire failed below limit")
+	}
+	if err := l.acquire("c"); err == nil {
+		t.Errorf("acquire should fail at limit")
+	}
+	l.release("a")
+	if err := l.acquire("c"); err != nil {
+		t.Errorf("acquire failed after release: %v", err)
+	}
+	s := l.stats()
+	if s.TotalLimitHits != 1 || s.Rejected != 1 {
+		t.Errorf("unexpected stats: %v", s)
+	}
+}
+
+func TestConnLimiterPerClient(t *testing.T) {
+	l := newConnLimiter(ConnLimits{MaxPerClient: 1})
+	if err := l.acquire("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire("a"); err == nil {
+		t.Errorf("acquire should fail at per-client limit")
+	}
+	if err := l.acquire("b"); err != nil {
+		t.Errorf("other client should not be limited: %v", err)
+	}
+	if s := l.stats(); s.ClientLimitHits != 1 {
+		t.Errorf("unexpected stats: %v", s)
+	}
+}
+
+func TestConnLimiterQueue(t *testing.T) {
+	l := newConnLimiter(ConnLimits{MaxTotal: 1, QueueTimeout: time.Second})
+	l.acquire("a")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l.release("a")
+	}()
+	if err := l.acquire("b"); err != nil {
+		t.Errorf("queued acquire failed: %v", err)
+	}
+
+	l = newConnLimiter(ConnLimits{MaxTotal: 1, QueueTimeout: 20 * time.Millisecond})
+	l.acquire("a")
+	queued := metrics.ConnLimitEvents.get("total", "queued")
+	rejected := metrics.ConnLimitEvents.get("total", "rejected")
+	if err := l.acquire("b"); err == nil {
+		t.Errorf("queued acquire should time out")
+	}
+	if s := l.stats(); s.Queued != 1 || s.Rejected != 1 {
+		t.Errorf("unexpected stats: %v", s)
+	}
+	ExpectEqual(t, "1 1", fmt.Sprint(metrics.ConnLimitEvents.get("total", "queued")-queued, " ",
+		metrics.ConnLimitEvents.get("total", "rejected")-rejected))
+}
+
+func TestServiceUnavailableResponse(t *testing.T) {
+	w := new(bytes.Buffer)
+	WriteResponse(w, serviceUnavailableResponse(1500*time.Millisecond))
+	if !strings.HasPrefix(w.String(), "HTTP/1.1 503 Service Unavailable\r\n") ||
+		!strings.Contains(w.String(), "Retry-After: 2\r\n") {
+		t.Errorf("unexpected response: %q", w.String())
+	}
+}
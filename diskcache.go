@@ -0,0 +1,323 @@
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskStore keeps entries in a directory, each as a metadata file named
+// after the hash of its key and a body file. Files are written under
+// temporary names and renamed into place once synced, the body first, so
+// a crash leaves either the previous entry or the new one. The least
+// recently used entries are evicted beyond |max| bytes; recency survives
+// restarts as the modification time of the metadata.
+type diskStore struct {
+	dir       string
+	max       int64
+	maxObject int64 // largest body stored
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // of *diskItem, most recently used first
+	items map[string]*list.Element
+}
+
+type diskItem struct {
+	key  string
+	body string // base name of the body file, empty for markers
+	size int64  // of both files
+}
+
+// diskMeta is the content of a metadata file.
+type diskMeta struct {
+	Key          string        `json:"key"`
+	Version      string        `json:"version,omitempty"` // no response for markers
+	Status       int           `json:"status,omitempty"`
+	Phrase       string        `json:"phrase,omitempty"`
+	Headers      HTTPHeader    `json:"headers,omitempty"`
+	RequestTime  time.Time     `json:"request_time"`
+	ResponseTime time.Time     `json:"response_time"`
+	InitialAge   time.Duration `json:"initial_age"`
+	Lifetime     time.Duration `json:"lifetime"`
+	Vary         []string      `json:"vary,omitempty"`
+	Gen          uint64        `json:"gen,omitempty"`
+	Body         string        `json:"body,omitempty"`
+	BodySize     int64         `json:"body_size"`
+}
+
+const (
+	diskMetaExt = ".meta"
+	diskBodyExt = ".body"
+)
+
+// openDiskStore indexes the entries in |dir|, creating it if needed, and
+// removes files left over by a crash.
+func openDiskStore(dir string, max, maxObject int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &diskStore{dir: dir, max: max, maxObject: maxObject,
+		lru: list.New(), items: make(map[string]*list.Element)}
+	type found struct {
+		item    *diskItem
+		modTime time.Time
+	}
+	var entries []found
+	bodies := map[string]bool{}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, diskMetaExt) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		fi, err := f.Info()
+		if err != nil {
+			continue
+		}
+		m, err := s.readMeta(path)
+		if err != nil || s.name(m.Key)+diskMetaExt != name || !s.bodyValid(m) {
+			logger.Warnf("cache: removing %s: invalid entry", path)
+			os.Remove(path)
+			continue
+		}
+		bodies[m.Body] = true
+		entries = append(entries, found{
+			&diskItem{key: m.Key, body: m.Body, size: fi.Size() + m.BodySize}, fi.ModTime()})
+	}
+	// Temporary files and bodies without metadata were not stored in full.
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, diskBodyExt) && !bodies[name] {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		s.items[e.item.key] = s.lru.PushFront(e.item)
+		s.grow(e.item.size)
+	}
+	s.evict()
+	return s, nil
+}
+
+// name is the base name of the files of |key|, without extension.
+func (s *diskStore) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *diskStore) readMeta(path string) (*diskMeta, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m diskMeta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// bodyValid tells if the body file of |m| is there in full.
+func (s *diskStore) bodyValid(m *diskMeta) bool {
+	if m.Status == 0 {
+		return m.Body == ""
+	}
+	if m.Body == "" || filepath.Base(m.Body) != m.Body {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(s.dir, m.Body))
+	return err == nil && fi.Size() == m.BodySize
+}
+
+func (s *diskStore) get(key string) *cacheEntry {
+	s.mu.Lock()
+	el, ok := s.items[key]
+	if ok {
+		s.lru.MoveToFront(el)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	path := filepath.Join(s.dir, s.name(key)+diskMetaExt)
+	m, err := s.readMeta(path)
+	if err != nil || m.Key != key || !s.bodyValid(m) {
+		logger.Warnf("cache: removing %s: invalid entry", path)
+		s.removeIf(key, el)
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	e := &cacheEntry{
+		bodySize:     m.BodySize,
+		requestTime:  m.RequestTime,
+		responseTime: m.ResponseTime,
+		initialAge:   m.InitialAge,
+		lifetime:     m.Lifetime,
+		vary:         m.Vary,
+		gen:          m.Gen,
+	}
+	if m.Status != 0 {
+		e.res = &Response{m.Version, m.Status, m.Phrase, m.Headers}
+		e.bodyFile = filepath.Join(s.dir, m.Body)
+	}
+	return e
+}
+
+// put takes over the body file of |e|, or writes its body to one.
+func (s *diskStore) put(key string, e *cacheEntry) {
+	m := &diskMeta{
+		Key:          key,
+		RequestTime:  e.requestTime,
+		ResponseTime: e.responseTime,
+		InitialAge:   e.initialAge,
+		Lifetime:     e.lifetime,
+		Vary:         e.vary,
+		Gen:          e.gen,
+		BodySize:     e.bodySize,
+	}
+	name := s.name(key)
+	if !e.isMarker() {
+		m.Version, m.Status, m.Phrase, m.Headers = e.res.Version, e.res.Status, e.res.Phrase, e.res.Headers
+		body, err := s.storeBody(name, e)
+		if err != nil {
+			logger.Warnf("cache: %v", err)
+			return
+		}
+		m.Body = body
+		e.bodyFile = filepath.Join(s.dir, body)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		logger.Warnf("cache: %v", err)
+		return
+	}
+	tmp, err := writeSynced(s.dir, ".meta-*", b)
+	if err != nil {
+		logger.Warnf("cache: %v", err)
+		os.Remove(e.bodyFile)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Renaming under the lock keeps the metadata in the order of the index.
+	if err := os.Rename(tmp, filepath.Join(s.dir, name+diskMetaExt)); err != nil {
+		logger.Warnf("cache: %v", err)
+		os.Remove(tmp)
+		os.Remove(e.bodyFile)
+		return
+	}
+	if el, ok := s.items[key]; ok {
+		old := s.lru.Remove(el).(*diskItem)
+		delete(s.items, key)
+		s.grow(-old.size)
+		if old.body != "" {
+			os.Remove(filepath.Join(s.dir, old.body))
+		}
+	}
+	item := &diskItem{key: key, body: m.Body, size: int64(len(b)) + m.BodySize}
+	s.items[key] = s.lru.PushFront(item)
+	s.grow(item.size)
+	s.evict()
+}
+
+// storeBody moves or writes the body of |e| to a new file and returns its
+// base name. Names are unique so that bodies being read are not replaced.
+func (s *diskStore) storeBody(name string, e *cacheEntry) (string, error) {
+	if e.bodySize > s.maxObject {
+		if e.bodyFile != "" {
+			os.Remove(e.bodyFile)
+		}
+		return "", fmt.Errorf("Body of %d bytes over %d, not stored", e.bodySize, s.maxObject)
+	}
+	src := e.bodyFile
+	if src == "" {
+		var err error
+		if src, err = writeSynced(s.dir, ".body-*", e.body); err != nil {
+			return "", err
+		}
+	}
+	var r [8]byte
+	rand.Read(r[:])
+	body := name + "-" + hex.EncodeToString(r[:]) + diskBodyExt
+	if err := os.Rename(src, filepath.Join(s.dir, body)); err != nil {
+		os.Remove(src)
+		return "", err
+	}
+	return body, nil
+}
+
+// writeSynced writes |b| to a new temporary file in |dir| and returns its
+// path.
+func writeSynced(dir, pattern string, b []byte) (string, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func (s *diskStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.removeElement(el)
+	}
+}
+
+// removeIf removes the entry of |key| unless replaced since |el| was
+// looked up.
+func (s *diskStore) removeIf(key string, el *list.Element) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.items[key] == el {
+		s.removeElement(el)
+	}
+}
+
+func (s *diskStore) removeElement(el *list.Element) {
+	item := s.lru.Remove(el).(*diskItem)
+	delete(s.items, item.key)
+	s.grow(-item.size)
+	os.Remove(filepath.Join(s.dir, s.name(item.key)+diskMetaExt))
+	if item.body != "" {
+		os.Remove(filepath.Join(s.dir, item.body))
+	}
+}
+
+func (s *diskStore) evict() {
+	for s.size > s.max && s.lru.Len() > 1 {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+func (s *diskStore) grow(n int64) {
+	s.size += n
+	metrics.CacheBytes.add(float64(n), "disk")
+}
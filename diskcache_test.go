@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func diskEntry(body string) *cacheEntry {
+	return &cacheEntry{
+		res:          cacheResponse("Cache-Control: max-age=60"),
+		body:         []byte(body),
+		bodySize:     int64(len(body)),
+		responseTime: cacheEpoch,
+		lifetime:     time.Minute,
+	}
+}
+
+func readDiskBody(t *testing.T, e *cacheEntry) string {
+	body, err := e.openBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	b, _ := io.ReadAll(body)
+	return string(b)
+}
+
+func TestDiskStoreReopen(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	dir := t.TempDir()
+	s, err := openDiskStore(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.put("a", diskEntry("body a"))
+	s.put("m", &cacheEntry{vary: []string{"accept"}, gen: 7})
+	s.put("b", diskEntry("body b"))
+	s.put("b", diskEntry("new b"))
+	os.WriteFile(filepath.Join(dir, ".fill-1"), []byte("partial"), 0644)
+	os.WriteFile(filepath.Join(dir, "orphan.body"), []byte("orphan"), 0644)
+
+	if s, err = openDiskStore(dir, 1<<20, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	e := s.get("a")
+	ExpectEqual(t, "body a max-age=60 1m0s", readDiskBody(t, e)+" "+
+		e.res.Headers["cache-control"]+" "+e.lifetime.String())
+	ExpectEqual(t, "new b", readDiskBody(t, s.get("b")))
+	m := s.get("m")
+	ExpectEqual(t, "true [accept] 7", fmt.Sprint(m.isMarker(), m.vary, m.gen))
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	ExpectEqual(t, "5", fmt.Sprint(len(files)))
+}
+
+func TestDiskStoreTruncatedBody(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	dir := t.TempDir()
+	s, err := openDiskStore(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.put("a", diskEntry("body a"))
+	s.put("b", diskEntry("body b"))
+	if err := os.Truncate(s.get("a").bodyFile, 2); err != nil {
+		t.Fatal(err)
+	}
+	if s.get("a") != nil {
+		t.Errorf("truncated body served")
+	}
+	if err := os.Truncate(s.get("b").bodyFile, 2); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = openDiskStore(dir, 1<<20, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if s.get("b") != nil {
+		t.Errorf("truncated body served after reopening")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	ExpectEqual(t, "0", fmt.Sprint(len(files)))
+}
+
+func TestDiskStoreEviction(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	dir := t.TempDir()
+	s, err := openDiskStore(dir, 1<<20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.put("big", diskEntry(strings.Repeat("x", 11)))
+	if s.get("big") != nil {
+		t.Errorf("stored body over the limit")
+	}
+	s.put("a", diskEntry("a"))
+	s.max = 3 * s.size
+
+	s.put("b", diskEntry("b"))
+	s.put("c", diskEntry("c"))
+	s.get("a")
+	s.put("d", diskEntry("d"))
+	keys := func(s *diskStore) string {
+		var kept []string
+		for _, k := range []string{"a", "b", "c", "d"} {
+			if s.get(k) != nil {
+				kept = append(kept, k)
+			}
+		}
+		return strings.Join(kept, " ")
+	}
+	ExpectEqual(t, "a c d", keys(s))
+
+	// Recency survives reopening.
+	now := time.Now()
+	for i, k := range []string{"d", "a", "c"} {
+		mtime := now.Add(time.Duration(i) * time.Second)
+		os.Chtimes(filepath.Join(dir, s.name(k)+diskMetaExt), mtime, mtime)
+	}
+	if s, err = openDiskStore(dir, 2*s.max/3, 10); err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "a c", keys(s))
+}
+
+func TestWorkerDiskCache(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	defer func() { responseCache = nil }()
+	dir := t.TempDir()
+	disk, err := openDiskStore(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseCache = NewCache(newMemoryStore(1<<20), disk, 4)
+
+	body := strings.Repeat("artifact", 1000)
+	var dials atomic.Int32
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		dials.Add(1)
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, c)
+		go fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\n"+
+			"Transfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+		return s, nil
+	}
+	get := func() string {
+		status, body := proxyOnPipe(t, "GET http://cached.example/x HTTP/1.1\r\n"+
+			"Host: cached.example\r\n\r\n")
+		return fmt.Sprint(status, " ", body)
+	}
+	ExpectEqual(t, "200 "+body, get())
+	bodies, _ := filepath.Glob(filepath.Join(dir, "*"+diskBodyExt))
+	ExpectEqual(t, "1", fmt.Sprint(len(bodies)))
+
+	// A new cache on the same directory serves it without dialing.
+	if disk, err = openDiskStore(dir, 1<<20, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	responseCache = NewCache(newMemoryStore(1<<20), disk, 4)
+	ExpectEqual(t, "200 "+body, get())
+	ExpectEqual(t, "1", fmt.Sprint(dials.Load()))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type FixtureMode int
+
+const (
+	FixtureRecord FixtureMode = iota // store upstream exchanges
+	FixtureReplay                    // answer from stored exchanges
+)
+
+// FixtureStore keeps upstream exchanges in a directory, one JSON file
+// per request keyed by method, URL, selected headers and body.
+type FixtureStore struct {
+	dir        string
+	mode       FixtureMode
+	headers    []string // lowercase names of request headers in the key
+	passMisses bool     // replay misses are sent to the server instead of failing
+}
+
+// Set by -record or -replay, nil otherwise.
+var fixtures *FixtureStore
+
+// Request bodies are read whole before replaying, and exchanges with
+// larger bodies are not recorded.
+var fixtureBodyLimit = 64 << 20
+
+var errBodyTooLarge = errors.New("Body too large")
+
+func NewFixtureStore(dir string, mode FixtureMode, headers []string, passMisses bool) (*FixtureStore, error) {
+	if mode == FixtureRecord {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	} else if fi, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s: Not a directory", dir)
+	}
+	s := &FixtureStore{dir: dir, mode: mode, passMisses: passMisses}
+	for _, h := range headers {
+		s.headers = append(s.headers, strings.ToLower(h))
+	}
+	return s, nil
+}
+
+// fixtureRequest is what tells recorded exchanges apart.
+type fixtureRequest struct {
+	Method     string            `json:"method"`
+	URL        string            `json:"url"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	BodySHA256 string            `json:"body_sha256"`
+}
+
+// fixtureResponse is the response as relayed, so a chunked body keeps its
+// framing.
+type fixtureResponse struct {
+	Version string     `json:"version"`
+	Status  int        `json:"status"`
+	Phrase  string     `json:"phrase"`
+	Headers HTTPHeader `json:"headers"`
+	Body    []byte     `json:"body,omitempty"`
+}
+
+type fixture struct {
+	Request  fixtureRequest  `json:"request"`
+	Response fixtureResponse `json:"response"`
+}
+
+// request builds the key of |req| as received from the client with its
+// body |raw| as relayed.
+func (s *FixtureStore) request(req *Request, raw []byte) fixtureRequest {
+	h := req.Headers
+	sum := sha256.Sum256(decodeBody(raw, h))
+	r := fixtureRequest{
+		Method:     req.Method,
+		URL:        requestURL(req),
+		BodySHA256: hex.EncodeToString(sum[:]),
+	}
+	for _, name := range s.headers {
+		if v, ok := h[name]; ok {
+			if r.Headers == nil {
+				r.Headers = map[string]string{}
+			}
+			r.Headers[name] = v
+		}
+	}
+	return r
+}
+
+func (s *FixtureStore) path(r fixtureRequest) string {
+	b, _ := json.Marshal(r) // map keys are sorted
+	sum := sha256.Sum256(b)
+	return filepath.Join(s.dir, strings.ToLower(r.Method)+"-"+hex.EncodeToString(sum[:16])+".json")
+}
+
+// Save stores the exchange, replacing one recorded for the same request.
+func (s *FixtureStore) Save(r fixtureRequest, res *Response, body []byte) error {
+	b, err := json.MarshalIndent(&fixture{r, fixtureResponse{
+		res.Version, res.Status, res.Phrase, res.Headers, body}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := s.path(r)
+	tmp, err := os.CreateTemp(s.dir, ".record-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load returns the recorded response, or an error satisfying
+// errors.Is(err, os.ErrNotExist) if there is none.
+func (s *FixtureStore) Load(r fixtureRequest) (*fixtureResponse, error) {
+	b, err := os.ReadFile(s.path(r))
+	if err != nil {
+		return nil, err
+	}
+	var f fixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path(r), err)
+	}
+	return &f.Response, nil
+}
+
+// fixtureCapture is what a worker keeps of a request being recorded.
+type fixtureCapture struct {
+	store   *FixtureStore
+	req     *Request // as received from the client
+	reqBody *bodyCapture
+	resBody *bodyCapture
+}
+
+func (s *FixtureStore) newCapture(req *Request) *fixtureCapture {
+	headers := make(HTTPHeader, len(req.Headers))
+	for k, v := range req.Headers {
+		headers[k] = v
+	}
+	return &fixtureCapture{
+		store:   s,
+		req:     &Request{req.Method, req.URI, req.Version, headers},
+		reqBody: &bodyCapture{limit: fixtureBodyLimit},
+		resBody: &bodyCapture{limit: fixtureBodyLimit},
+	}
+}
+
+// save records the exchange once |res| was relayed in full.
+func (c *fixtureCapture) save(res *Response) error {
+	reqBody, ok1 := c.reqBody.bytes()
+	resBody, ok2 := c.resBody.bytes()
+	if !ok1 || !ok2 {
+		return fmt.Errorf("Body over %d bytes, not recorded", fixtureBodyLimit)
+	}
+	return c.store.Save(c.store.request(c.req, reqBody), res, resBody)
+}
+
+// replayMissResponse is sent for requests not recorded.
+func replayMissResponse(method, url string) (*Response, []byte) {
+	body := []byte("No recorded response for " + method + " " + url + "\n")
+	return &Response{
+		Version: "HTTP/1.1",
+		Status:  502,
+		Phrase:  "Bad Gateway",
+		Headers: HTTPHeader{
+			"content-type":   "text/plain; charset=utf-8",
+			"content-length": strconv.Itoa(len(body)),
+		},
+	}, body
+}
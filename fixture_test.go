@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// proxyOnPipe sends |req| through a worker and returns the status and
+// body of the response.
+func proxyOnPipe(t *testing.T, req string) (int, string) {
+	res, body := proxyResponseOnPipe(t, req)
+	return res.StatusCode, body
+}
+
+func proxyResponseOnPipe(t *testing.T, req string) (*http.Response, string) {
+	client, finished := runWorkerOnPipe(Timeouts{})
+	defer func() {
+		client.Close()
+		<-finished
+	}()
+	go io.WriteString(client, req)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	return res, string(body)
+}
+
+func TestFixtureRecordReplay(t *testing.T) {
+	_, restore := captureLog(LevelError)
+	defer restore()
+	defer func() { fixtures = nil }()
+	dir := filepath.Join(t.TempDir(), "fixtures")
+
+	var dials atomic.Int32
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		n := dials.Add(1)
+		s, c := net.Pipe()
+		go func() {
+			r := bufio.NewReader(c)
+			req, err := http.ReadRequest(r)
+			if err != nil {
+				return
+			}
+			body, _ := io.ReadAll(req.Body)
+			chunk := fmt.Sprintf("%s #%d", body, n)
+			fmt.Fprintf(c, "HTTP/1.1 201 Created\r\nTransfer-Encoding: chunked\r\n\r\n"+
+				"%x\r\n%s\r\n0\r\n\r\n", len(chunk), chunk)
+			io.Copy(io.Discard, c)
+		}()
+		return s, nil
+	}
+	post := func(variant, body string) string {
+		return fmt.Sprintf("POST http://api.example/items?x=1 HTTP/1.1\r\nHost: api.example\r\n"+
+			"X-Variant: %s\r\nContent-Length: %d\r\n\r\n%s", variant, len(body), body)
+	}
+
+	s, err := NewFixtureStore(dir, FixtureRecord, []string{"X-Variant"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures = s
+	for _, variant := range []string{"a", "b"} {
+		status, body := proxyOnPipe(t, post(variant, "hello"))
+		ExpectEqual(t, "201 hello #"+fmt.Sprint(dials.Load()), fmt.Sprint(status, " ", body))
+	}
+	// Nothing is recorded for a server other than the one dialed.
+	status, _ := proxyOnPipe(t, strings.Replace(post("c", "hello"), "Host: api.example", "Host: evil.example", 1))
+	ExpectEqual(t, "400", fmt.Sprint(status))
+	names, _ := filepath.Glob(filepath.Join(dir, "post-*.json"))
+	ExpectEqual(t, "2", fmt.Sprint(len(names)))
+
+	if fixtures, err = NewFixtureStore(dir, FixtureReplay, []string{"X-Variant"}, false); err != nil {
+		t.Fatal(err)
+	}
+	dials.Store(100)
+	for i, variant := range []string{"a", "b"} {
+		status, body := proxyOnPipe(t, post(variant, "hello"))
+		ExpectEqual(t, fmt.Sprintf("201 hello #%d", i+1), fmt.Sprint(status, " ", body))
+	}
+	status, _ = proxyOnPipe(t, strings.Replace(post("a", "hello"), "Host: api.example", "Host: evil.example", 1))
+	ExpectEqual(t, "400", fmt.Sprint(status))
+	// The body is compared decoded.
+	status, body := proxyOnPipe(t, "POST http://api.example/items?x=1 HTTP/1.1\r\n"+
+		"Host: api.example\r\nX-Variant: a\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"2\r\nhe\r\n3\r\nllo\r\n0\r\n\r\n")
+	ExpectEqual(t, "201 hello #1", fmt.Sprint(status, " ", body))
+	ExpectEqual(t, "100", fmt.Sprint(dials.Load()))
+
+	status, body = proxyOnPipe(t, post("a", "other"))
+	ExpectEqual(t, "502 No recorded response for POST http://api.example/items?x=1\n",
+		fmt.Sprint(status, " ", body))
+	status, _ = proxyOnPipe(t, post("c", "hello"))
+	ExpectEqual(t, "502", fmt.Sprint(status))
+	ExpectEqual(t, "100", fmt.Sprint(dials.Load()))
+
+	fixtures.passMisses = true
+	status, body = proxyOnPipe(t, post("a", "other"))
+	ExpectEqual(t, "201 other #101", fmt.Sprint(status, " ", body))
+}
+
+func TestFixtureStoreReplayDir(t *testing.T) {
+	if _, err := NewFixtureStore(filepath.Join(t.TempDir(), "missing"), FixtureReplay, nil, false); !os.IsNotExist(err) {
+		t.Errorf("got %v, want not exist", err)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// HARRecorder appends the requests of workers to an HTTP Archive 1.2
+// file. The file is valid JSON after every entry.
+type HARRecorder struct {
+	mu        sync.Mutex
+	f         *os.File
+	path      string
+	entries   int
+	hosts     []string // patterns of hosts to record, all if empty
+	bodyLimit int      // body bytes kept per message, 0 for none
+	enabled   atomic.Bool
+}
+
+const harHeader = `{"log":{"version":"1.2","creator":{"name":"proxy","version":"1.0"},"entries":[`
+const harTrailer = "\n]}}\n"
+
+// Set by -har, nil if not recording.
+var harRecorder *HARRecorder
+
+// OpenHARRecorder truncates |path| and starts recording.
+func OpenHARRecorder(path string, hosts []string, bodyLimit int) (*HARRecorder, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(f, harHeader+harTrailer); err != nil {
+		f.Close()
+		return nil, err
+	}
+	h := &HARRecorder{f: f, path: path, hosts: hosts, bodyLimit: bodyLimit}
+	h.enabled.Store(true)
+	return h, nil
+}
+
+// SetEnabled pauses or resumes recording. Requests already being
+// recorded are still added.
+func (h *HARRecorder) SetEnabled(on bool) {
+	h.enabled.Store(on)
+}
+
+func (h *HARRecorder) Enabled() bool {
+	return h.enabled.Load()
+}
+
+// Entries returns the number of entries written.
+func (h *HARRecorder) Entries() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.entries
+}
+
+// records reports whether requests to |host| are recorded now.
+func (h *HARRecorder) records(host string) bool {
+	if !h.Enabled() {
+		return false
+	}
+	if len(h.hosts) == 0 {
+		return true
+	}
+	for _, p := range h.hosts {
+		if matchHostPattern(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add writes |e| in place of the trailer and writes the trailer again.
+func (h *HARRecorder) Add(e *harEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		return fmt.Errorf("%s: Recorder is closed", h.path)
+	}
+	sep := ",\n"
+	if h.entries == 0 {
+		sep = "\n"
+	}
+	if _, err := h.f.Seek(-int64(len(harTrailer)), io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := h.f.WriteString(sep + string(b) + harTrailer); err != nil {
+		return err
+	}
+	h.entries++
+	return nil
+}
+
+func (h *HARRecorder) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		return nil
+	}
+	err := h.f.Close()
+	h.f = nil
+	return err
+}
+
+// bodyCapture keeps the first |limit| bytes written to it.
+type bodyCapture struct {
+	mu    sync.Mutex
+	limit int
+	b     []byte
+	size  int64 // all bytes written
+}
+
+func (c *bodyCapture) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := c.limit - len(c.b); n > 0 {
+		c.b = append(c.b, b[:min(n, len(b))]...)
+	}
+	c.size += int64(len(b))
+	return len(b), nil
+}
+
+// bytes returns the kept bytes and whether they are the whole body.
+func (c *bodyCapture) bytes() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.b, int64(len(c.b)) == c.size
+}
+
+// harCapture is what a worker keeps of a recorded request.
+type harCapture struct {
+	recorder *HARRecorder
+	headers  HTTPHeader // request headers as received from the client
+	reqBody  *bodyCapture
+	resBody  *bodyCapture
+}
+
+func (h *HARRecorder) newCapture(req *Request) *harCapture {
+	headers := make(HTTPHeader, len(req.Headers))
+	for k, v := range req.Headers {
+		headers[k] = v
+	}
+	return &harCapture{
+		recorder: h,
+		headers:  headers,
+		reqBody:  &bodyCapture{limit: h.bodyLimit},
+		resBody:  &bodyCapture{limit: h.bodyLimit},
+	}
+}
+
+// HAR 1.2 objects. Times are in milliseconds, -1 if not applicable.
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// Fields whose values are credentials, kept out of HAR files.
+var harRedactedHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+}
+
+func harHeaders(h HTTPHeader) []harNameValue {
+	out := make([]harNameValue, 0, len(h))
+	for k, v := range h {
+		if harRedactedHeaders[k] {
+			v = "[REDACTED]"
+		}
+		out = append(out, harNameValue{k, v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func harQuery(u *url.URL) []harNameValue {
+	out := []harNameValue{}
+	if u == nil {
+		return out
+	}
+	q := u.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range q[k] {
+			out = append(out, harNameValue{k, v})
+		}
+	}
+	return out
+}
+
+// harBody removes the chunked framing of a captured body and encodes it
+// as text. |complete| is false if the body was cut at the limit.
+func harBody(b []byte, complete bool, h HTTPHeader) (body []byte, text, encoding, comment string) {
+	b = decodeBody(b, h)
+	text = string(b)
+	if !utf8.Valid(b) {
+		text, encoding = base64.StdEncoding.EncodeToString(b), "base64"
+	}
+	if !complete {
+		comment = "truncated to " + strconv.Itoa(len(b)) + " bytes"
+	}
+	return b, text, encoding, comment
+}
+
+// harEntry describes the request of the worker. Timings are split at the
+// state transitions recorded in w.times.
+func (w *Worker) harEntry() *harEntry {
+	end := time.Now()
+	t := w.times
+	c := w.har
+	e := &harEntry{
+		StartedDateTime: t.received,
+		Connection:      strconv.FormatUint(w.connID, 10),
+		Comment:         w.termination,
+		Timings:         harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1},
+	}
+
+	rawURL := requestURL(w.req)
+	u, _ := url.Parse(rawURL)
+	e.Request = harRequest{
+		Method:      w.req.Method,
+		URL:         rawURL,
+		HTTPVersion: w.req.Version,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(c.headers),
+		QueryString: harQuery(u),
+		HeadersSize: -1,
+		BodySize:    w.bytesIn.Load(),
+	}
+	if b, complete := c.reqBody.bytes(); len(b) > 0 {
+		_, text, encoding, comment := harBody(b, complete, c.headers)
+		if encoding != "" {
+			// postData has no encoding field.
+			comment = strings.TrimPrefix(comment+", base64", ", ")
+		}
+		e.Request.PostData = &harPostData{
+			MimeType: c.headers["content-type"], Text: text, Comment: comment}
+	}
+
+	e.Response = harResponse{
+		Cookies:     []harNameValue{},
+		Headers:     []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    w.bytesOut.Load() + int64(len(w.resBody)),
+	}
+	if res := w.res; res != nil {
+		e.Response.Status = res.Status
+		e.Response.StatusText = res.Phrase
+		e.Response.HTTPVersion = res.Version
+		e.Response.Headers = harHeaders(res.Headers)
+		e.Response.RedirectURL = res.Headers["location"]
+		e.Response.Content = harContent{
+			Size: e.Response.BodySize, MimeType: res.Headers["content-type"]}
+		b, complete := c.resBody.bytes()
+		if len(w.resBody) > 0 {
+			b, complete = w.resBody, true
+		}
+		if len(b) > 0 {
+			content := &e.Response.Content
+			var body []byte
+			body, content.Text, content.Encoding, content.Comment = harBody(b, complete, res.Headers)
+			if complete {
+				content.Size = int64(len(body))
+			}
+		}
+	}
+	if w.serverConn != nil {
+		e.ServerIPAddress = hostWithoutPort(w.serverConn.RemoteAddr().String())
+	}
+
+	// blocked: checks before dialing, send: from the dial to the request
+	// sent, wait: to the response header, receive: to the end.
+	last := t.received
+	if !t.dialStart.IsZero() {
+		e.Timings.Blocked = milliseconds(t.dialStart.Sub(last))
+		e.Timings.Connect = milliseconds(t.dial)
+		last = t.dialStart.Add(t.dial)
+	}
+	if !t.sent.IsZero() {
+		e.Timings.Send = milliseconds(t.sent.Sub(last))
+		last = t.sent
+	}
+	if !t.responded.IsZero() {
+		e.Timings.Wait = milliseconds(t.responded.Sub(last))
+		last = t.responded
+		e.Timings.Receive = milliseconds(end.Sub(last))
+	} else {
+		e.Timings.Wait = milliseconds(end.Sub(last))
+	}
+	e.Time = milliseconds(end.Sub(t.received))
+	return e
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readHAR(t *testing.T, path string) []harEntry {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har struct {
+		Log struct {
+			Version string     `json:"version"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(b, &har); err != nil {
+		t.Fatalf("invalid HAR: %v\n%s", err, b)
+	}
+	ExpectEqual(t, "1.2", har.Log.Version)
+	return har.Log.Entries
+}
+
+func TestHARRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.har")
+	h, err := OpenHARRecorder(path, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "0", fmt.Sprint(len(readHAR(t, path))))
+	for i := 1; i <= 2; i++ {
+		if err := h.Add(&harEntry{Comment: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+		entries := readHAR(t, path)
+		ExpectEqual(t, fmt.Sprint(i), fmt.Sprint(len(entries)))
+		ExpectEqual(t, fmt.Sprint(i), entries[i-1].Comment)
+	}
+	h.Close()
+	if err := h.Add(&harEntry{}); err == nil {
+		t.Errorf("expected error after close")
+	}
+}
+
+func TestWorkerHAR(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.har")
+	h, err := OpenHARRecorder(path, []string{".recorded.example"}, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	harRecorder = h
+	defer func() { harRecorder = nil }()
+
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, c)
+		go io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nSet-Cookie: id=s3cr3t\r\n"+
+			"Transfer-Encoding: chunked\r\n\r\n6\r\nFooBar\r\n0\r\n\r\n")
+		return s, nil
+	}
+	body := "0123456789abcdefghijklmnopqrstuvwxyz0123"
+	proxy := func(host string) {
+		client, finished := runWorkerOnPipe(Timeouts{})
+		fmt.Fprintf(client, "POST /path?b=2&a=1 HTTP/1.1\r\nHost: %s\r\n"+
+			"Proxy-Authorization: Basic dXNlcjpwYXNz\r\nCookie: id=s3cr3t\r\n"+
+			"Content-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s", host, len(body), body)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		r := bufio.NewReader(client)
+		for line := ""; line != "0\r\n"; {
+			if line, err = r.ReadString('\n'); err != nil {
+				t.Fatalf("reading response: %v", err)
+			}
+		}
+		r.ReadString('\n')
+		client.Close()
+		<-finished
+	}
+	proxy("www.recorded.example")
+	proxy("other.example")
+	h.SetEnabled(false)
+	proxy("www.recorded.example")
+
+	entries := readHAR(t, path)
+	ExpectEqual(t, "1", fmt.Sprint(len(entries)))
+	e := entries[0]
+	ExpectEqual(t, "POST http://www.recorded.example/path?b=2&a=1 HTTP/1.1",
+		e.Request.Method+" "+e.Request.URL+" "+e.Request.HTTPVersion)
+	ExpectEqual(t, "[{a 1} {b 2}]", fmt.Sprint(e.Request.QueryString))
+	ExpectEqual(t, "[{content-length 40} {content-type text/plain} {cookie [REDACTED]} "+
+		"{host www.recorded.example} {proxy-authorization [REDACTED]}]",
+		fmt.Sprint(e.Request.Headers))
+	ExpectEqual(t, "40", fmt.Sprint(e.Request.BodySize))
+	ExpectEqual(t, "0123456789abcdefghijklmnopqrstuv", e.Request.PostData.Text)
+	ExpectEqual(t, "truncated to 32 bytes", e.Request.PostData.Comment)
+
+	ExpectEqual(t, "200 OK", fmt.Sprint(e.Response.Status, " ", e.Response.StatusText))
+	ExpectEqual(t, "[{content-type text/plain} {set-cookie [REDACTED]} {transfer-encoding chunked}]",
+		fmt.Sprint(e.Response.Headers))
+	ExpectEqual(t, "FooBar 6 text/plain", fmt.Sprint(e.Response.Content.Text, " ",
+		e.Response.Content.Size, " ", e.Response.Content.MimeType))
+	ExpectEqual(t, "", e.Response.Content.Comment)
+
+	tm := e.Timings
+	if tm.Connect < 0 || tm.Send < 0 || tm.Wait < 0 || tm.Receive < 0 {
+		t.Errorf("missing timings: %+v", tm)
+	}
+	sum := tm.Blocked + tm.Connect + tm.Send + tm.Wait + tm.Receive
+	if diff := sum - e.Time; diff > 0.01 || diff < -0.01 {
+		t.Errorf("timings add up to %v, want %v", sum, e.Time)
+	}
+}
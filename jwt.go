@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwk is a JSON Web Key as found in a JWKS file. Only public key fields
+// are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtKey struct {
+	kid string
+	alg string // may be empty
+	pub crypto.PublicKey
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("Invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("Invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("EC point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("Unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("Unsupported key type: %s", k.Kty)
+}
+
+func parseJWKS(b []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	var keys []jwtKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (%s): %v", i, k.Kid, err)
+		}
+		keys = append(keys, jwtKey{k.Kid, k.Alg, pub})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No signing keys")
+	}
+	return keys, nil
+}
+
+// jwksFile holds keys loaded from a JWKS file and reloads it when it
+// changes.
+type jwksFile struct {
+	file watchedFile
+	mu   sync.RWMutex
+	keys []jwtKey
+}
+
+func newJWKSFile(path string) (*jwksFile, error) {
+	f := &jwksFile{file: watchedFile{path: path}}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *jwksFile) load() error {
+	if err := f.file.loaded(); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(f.file.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.file.path, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys = keys
+	return nil
+}
+
+func (f *jwksFile) watch(interval time.Duration, done <-chan struct{}) {
+	pollFiles([]*watchedFile{&f.file}, interval, done, f.load)
+}
+
+// candidates returns the keys that may have signed a token.
+func (f *jwksFile) candidates(kid, alg string) []jwtKey {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var keys []jwtKey
+	for _, k := range f.keys {
+		if (kid == "" || k.kid == kid) && (k.alg == "" || k.alg == alg) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func verifyJWTSignature(alg string, pub crypto.PublicKey, signed, sig []byte) bool {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "RS") && hash != 0:
+		k, ok := pub.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case strings.HasPrefix(alg, "PS") && hash != 0:
+		k, ok := pub.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(k, hash, digest, sig, nil) == nil
+	case strings.HasPrefix(alg, "ES") && hash != 0:
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	case alg == "EdDSA":
+		k, ok := pub.(ed25519.PublicKey)
+		return ok && ed25519.Verify(k, signed, sig)
+	}
+	return false
+}
+
+// JWTValidation configures which tokens are accepted and how claims map
+// to an identity.
+type JWTValidation struct {
+	Issuer      string // required "iss" if not empty
+	Audience    string // required in "aud" if not empty
+	UserClaim   string
+	GroupsClaim string
+	Leeway      time.Duration // allowed clock skew for "exp" and "nbf"
+}
+
+var DefaultJWTValidation = JWTValidation{
+	UserClaim:   "sub",
+	GroupsClaim: "groups",
+	Leeway:      time.Minute,
+}
+
+// BearerAuthenticator accepts JWTs signed by a key in a JWKS file.
+type BearerAuthenticator struct {
+	keys  *jwksFile
+	v     JWTValidation
+	realm string
+	now   func() time.Time
+}
+
+func NewBearerAuthenticator(keys *jwksFile, v JWTValidation, realm string) *BearerAuthenticator {
+	return &BearerAuthenticator{keys, v, realm, time.Now}
+}
+
+func (a *BearerAuthenticator) Challenge() string {
+	return fmt.Sprintf("Bearer realm=%q", a.realm)
+}
+
+func (a *BearerAuthenticator) Authenticate(authorization string) (Identity, error) {
+	scheme, token := splitAuthorization(authorization)
+	if !strings.EqualFold(scheme, "Bearer") {
+		return Identity{}, ErrNoCredentials
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return a.identity(claims)
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verify checks the signature and time and audience claims of |token|
+// and returns its claims.
+func (a *BearerAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Malformed header")
+	}
+	if header.Alg == "" || header.Alg == "none" || len(header.Alg) < 5 {
+		return nil, fmt.Errorf("Unsupported alg: %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range a.keys.candidates(header.Kid, header.Alg) {
+		if verifyJWTSignature(header.Alg, k.pub, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("Invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Malformed claims")
+	}
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("Missing exp")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(a.v.Leeway)) {
+		return nil, fmt.Errorf("Token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok &&
+		now.Add(a.v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("Token not valid yet")
+	}
+	if a.v.Issuer != "" && claims["iss"] != a.v.Issuer {
+		return nil, fmt.Errorf("Unexpected issuer: %v", claims["iss"])
+	}
+	if a.v.Audience != "" && !hasAudience(claims["aud"], a.v.Audience) {
+		return nil, fmt.Errorf("Unexpected audience: %v", claims["aud"])
+	}
+	return claims, nil
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, a := range v {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *BearerAuthenticator) identity(claims map[string]interface{}) (Identity, error) {
+	user, ok := claims[a.v.UserClaim].(string)
+	if !ok || user == "" {
+		return Identity{}, fmt.Errorf("%w: missing %s claim", ErrInvalidCredentials, a.v.UserClaim)
+	}
+	id := Identity{User: user}
+	switch v := claims[a.v.GroupsClaim].(type) {
+	case string:
+		id.Groups = strings.Fields(v)
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+	return id, nil
+}
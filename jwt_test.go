@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSigner struct {
+	kid  string
+	alg  string
+	key  crypto.Signer
+	jwk  map[string]string
+	sign func(key crypto.Signer, signed []byte) []byte
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newTestSigners(t *testing.T) []*testSigner {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edk, _ := ed25519.GenerateKey(rand.Reader)
+
+	sha := func(b []byte) []byte {
+		h := sha256.Sum256(b)
+		return h[:]
+	}
+	return []*testSigner{
+		{"rsa", "RS256", rk, map[string]string{
+			"kty": "RSA", "n": b64(rk.N.Bytes()), "e": b64(big.NewInt(int64(rk.E)).Bytes())},
+			func(k crypto.Signer, b []byte) []byte {
+				sig, _ := k.Sign(rand.Reader, sha(b), crypto.SHA256)
+				return sig
+			}},
+		{"ec", "ES256", ek, map[string]string{
+			"kty": "EC", "crv": "P-256", "x": b64(ek.X.FillBytes(make([]byte, 32))),
+			"y": b64(ek.Y.FillBytes(make([]byte, 32)))},
+			func(k crypto.Signer, b []byte) []byte {
+				r, s, _ := ecdsa.Sign(rand.Reader, k.(*ecdsa.PrivateKey), sha(b))
+				return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+			}},
+		{"ed", "EdDSA", edk, map[string]string{
+			"kty": "OKP", "crv": "Ed25519", "x": b64(edk.Public().(ed25519.PublicKey))},
+			func(k crypto.Signer, b []byte) []byte {
+				return ed25519.Sign(k.(ed25519.PrivateKey), b)
+			}},
+	}
+}
+
+func (s *testSigner) token(claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+	return signed + "." + b64(s.sign(s.key, []byte(signed)))
+}
+
+func writeJWKS(t *testing.T, signers []*testSigner) string {
+	var keys []map[string]string
+	for _, s := range signers {
+		k := map[string]string{"kid": s.kid, "use": "sig"}
+		for n, v := range s.jwk {
+			k[n] = v
+		}
+		keys = append(keys, k)
+	}
+	b, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return writeTempFile(t, "jwks.json", string(b))
+}
+
+func TestBearerAuthenticator(t *testing.T) {
+	signers := newTestSigners(t)
+	keys, err := newJWKSFile(writeJWKS(t, signers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := DefaultJWTValidation
+	v.Issuer = "https://ci.example.com"
+	v.Audience = "proxy"
+	a := NewBearerAuthenticator(keys, v, "proxy")
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":    "https://ci.example.com",
+			"aud":    []string{"other", "proxy"},
+			"sub":    "job-42",
+			"groups": []string{"ci", "builders"},
+			"exp":    now.Add(time.Minute).Unix(),
+		}
+	}
+	for _, s := range signers {
+		id, err := a.Authenticate("Bearer " + s.token(valid()))
+		if err != nil {
+			t.Errorf("%s: %v", s.alg, err)
+			continue
+		}
+		ExpectEqual(t, "job-42", id.User)
+		ExpectEqual(t, "ci builders", strings.Join(id.Groups, " "))
+	}
+
+	invalid := map[string]func(c map[string]interface{}){
+		"expired":      func(c map[string]interface{}) { c["exp"] = now.Add(-2 * time.Minute).Unix() },
+		"no exp":       func(c map[string]interface{}) { delete(c, "exp") },
+		"not yet":      func(c map[string]interface{}) { c["nbf"] = now.Add(2 * time.Minute).Unix() },
+		"issuer":       func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"audience":     func(c map[string]interface{}) { c["aud"] = "other" },
+		"missing user": func(c map[string]interface{}) { delete(c, "sub") },
+	}
+	for name, modify := range invalid {
+		c := valid()
+		modify(c)
+		if _, err := a.Authenticate("Bearer " + signers[0].token(c)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	// within leeway
+	c := valid()
+	c["exp"] = now.Add(-30 * time.Second).Unix()
+	if _, err := a.Authenticate("Bearer " + signers[1].token(c)); err != nil {
+		t.Errorf("leeway: %v", err)
+	}
+
+	// tampered claims
+	tok := strings.Split(signers[0].token(valid()), ".")
+	forged := valid()
+	forged["sub"] = "admin"
+	fc, _ := json.Marshal(forged)
+	tok[1] = b64(fc)
+	if _, err := a.Authenticate("Bearer " + strings.Join(tok, ".")); err == nil {
+		t.Errorf("forged token accepted")
+	}
+
+	// alg none
+	h, _ := json.Marshal(map[string]string{"alg": "none"})
+	none := fmt.Sprintf("%s.%s.", b64(h), b64(fc))
+	if _, err := a.Authenticate("Bearer " + none); err == nil {
+		t.Errorf("alg none accepted")
+	}
+
+	if _, err := a.Authenticate(basicCredentials("alice", "secret")); err != ErrNoCredentials {
+		t.Errorf("got %v, want ErrNoCredentials", err)
+	}
+}
+
+func TestMultiAuthenticator(t *testing.T) {
+	f, err := newHtpasswdFile(writeTempFile(t, "htpasswd", testHtpasswd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := newTestSigners(t)[1:]
+	keys, err := newJWKSFile(writeJWKS(t, signers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := multiAuthenticator{
+		NewBasicAuthenticator(f, "proxy"),
+		NewBearerAuthenticator(keys, DefaultJWTValidation, "proxy"),
+	}
+	ExpectEqual(t, `Basic realm="proxy", Bearer realm="proxy"`, m.Challenge())
+
+	if id, err := m.Authenticate(basicCredentials("alice", "secret")); err != nil || id.User != "alice" {
+		t.Errorf("basic: %v %v", id, err)
+	}
+	tok := signers[0].token(map[string]interface{}{
+		"sub": "bob", "groups": "a b", "exp": time.Now().Add(time.Minute).Unix()})
+	if id, err := m.Authenticate("Bearer " + tok); err != nil || id.User != "bob" || !id.inGroup("b") {
+		t.Errorf("bearer: %v %v", id, err)
+	}
+	if _, err := m.Authenticate(""); err != ErrNoCredentials {
+		t.Errorf("got %v, want ErrNoCredentials", err)
+	}
+}
+
+func TestParseJWKSErrors(t *testing.T) {
+	for _, s := range []string{
+		`not json`,
+		`{"keys": []}`,
+		`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`,
+		`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+		`{"keys": [{"kty": "OKP", "crv": "Ed25519", "x": "AQ"}]}`,
+	} {
+		if _, err := parseJWKS([]byte(s)); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
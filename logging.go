@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("LogLevel(%d)", int32(l))
+	}
+	return logLevelNames[l]
+}
+
+// letter is the prefix of lines of this level.
+func (l LogLevel) letter() string {
+	return strings.ToUpper(l.String()[:1])
+}
+
+func parseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if s == name {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level: %s", s)
+}
+
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(int32(LevelInfo))
+}
+
+// SetLogLevel changes the minimum level logged. It can be called at any
+// time.
+func SetLogLevel(l LogLevel) {
+	logLevel.Store(int32(l))
+}
+
+func currentLogLevel() LogLevel {
+	return LogLevel(logLevel.Load())
+}
+
+// Logger writes lines through the standard logger, prefixed with the
+// level letter and its fields, e.g. "I conn=3 req=7 waiting response".
+// Loggers are immutable and safe for concurrent use.
+type Logger struct {
+	fields string
+	// Log debug lines regardless of the level, see -debug-host.
+	trace bool
+}
+
+// Used outside of workers.
+var logger = &Logger{}
+
+// With returns a logger adding key=value to each line.
+func (l *Logger) With(key string, value any) *Logger {
+	v := fmt.Sprint(value)
+	if v == "" || strings.ContainsAny(v, " \"=") {
+		v = fmt.Sprintf("%q", v)
+	}
+	return &Logger{fields: l.fields + key + "=" + v + " ", trace: l.trace}
+}
+
+// Traced returns a logger that logs debug lines at any level.
+func (l *Logger) Traced() *Logger {
+	return &Logger{fields: l.fields, trace: true}
+}
+
+// Enabled reports whether lines of |level| are written.
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= currentLogLevel() || (l.trace && level == LevelDebug)
+}
+
+func (l *Logger) logf(level LogLevel, format string, args ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+	log.Output(3, level.letter()+" "+l.fields+fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Debugf(format string, args ...any) {
+	l.logf(LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...any) {
+	l.logf(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...any) {
+	l.logf(LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...any) {
+	l.logf(LevelError, format, args...)
+}
+
+// logLevelFlag sets the global log level.
+type logLevelFlag struct{}
+
+func (logLevelFlag) String() string {
+	return LevelInfo.String()
+}
+
+func (logLevelFlag) Set(s string) error {
+	l, err := parseLogLevel(s)
+	if err != nil {
+		return err
+	}
+	SetLogLevel(l)
+	return nil
+}
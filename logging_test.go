@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent writers.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func captureLog(level LogLevel) (*syncBuffer, func()) {
+	b := &syncBuffer{}
+	saved := currentLogLevel()
+	log.SetOutput(b)
+	log.SetFlags(0)
+	SetLogLevel(level)
+	return b, func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		SetLogLevel(saved)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	b, restore := captureLog(LevelInfo)
+	defer restore()
+
+	l := logger.With("conn", 3).With("user", "a b")
+	l.Debugf("hidden")
+	l.Infof("shown %d", 1)
+	l.Traced().Debugf("traced")
+	SetLogLevel(LevelError)
+	l.Warnf("hidden")
+	l.Errorf("failed")
+	ExpectEqual(t, "I conn=3 user=\"a b\" shown 1\n"+
+		"D conn=3 user=\"a b\" traced\n"+
+		"E conn=3 user=\"a b\" failed\n", b.String())
+
+	for _, s := range []string{"debug", "info", "warn", "error"} {
+		l, err := parseLogLevel(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ExpectEqual(t, s, l.String())
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestWorkerDebugHost(t *testing.T) {
+	b, restore := captureLog(LevelError)
+	defer restore()
+	defer installedSettings.Store(nil)
+	s := flagSettings()
+	s.DebugHosts = []string{".traced.example"}
+	installedSettings.Store(s)
+
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, c)
+		go io.WriteString(c, "HTTP/1.1 204 No Content\r\nContent-Length: 0\r\n\r\n")
+		return s, nil
+	}
+	for _, host := range []string{"www.traced.example", "other.example"} {
+		client, finished := runWorkerOnPipe(Timeouts{})
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		bufio.NewReader(client).ReadString('\n')
+		client.Close()
+		<-finished
+	}
+
+	out := strings.TrimSpace(b.String())
+	if out == "" {
+		t.Fatalf("no debug lines logged")
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "D conn=") || !strings.Contains(line, " req=") {
+			t.Errorf("unexpected line: %q", line)
+		}
+		if strings.Contains(line, "other.example") {
+			t.Errorf("untraced host logged: %q", line)
+		}
+	}
+}
@@ -2,36 +2,375 @@ package main
 
 import (
 	"flag"
-	"log"
 	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var port = flag.String("port", "8082", "port number")
+var configPath = flag.String("config", "",
+	"JSON configuration file overriding flags, reloaded on SIGHUP or change")
+var htpasswdPath = flag.String("htpasswd", "",
+	"require Basic proxy authentication against this htpasswd file (bcrypt only)")
+var jwksPath = flag.String("jwks", "",
+	"require Bearer proxy authentication with JWTs signed by a key in this JWKS file")
+var jwtValidation = DefaultJWTValidation
+var blocklistPaths stringsFlag
+var sinkholeStatus = flag.Int("sinkhole-status", 0,
+	"status sent to requests for blocked domains (0 for 403)")
+var sinkholeBody = flag.String("sinkhole-body", "",
+	"file sent as body of the sinkhole response")
+var sinkholeType = flag.String("sinkhole-type", "text/html",
+	"content type of -sinkhole-body")
+var accessLogPath = flag.String("access-log", "",
+	"write one line per request to this file, or \"stdout\"")
+var accessLogFormat = flag.String("access-log-format", string(AccessLogCombined),
+	"access log format: common, combined or json")
+var debugHosts stringsFlag
+var metricsAddr = flag.String("metrics-addr", "",
+	"serve Prometheus metrics at /metrics on this address, e.g. 127.0.0.1:9100")
+var adminAddr = flag.String("admin-addr", "",
+	"serve the admin API on this address, requires -admin-token-file")
+var adminTokenFile = flag.String("admin-token-file", "",
+	"file holding the bearer token of the admin API")
+var traceEndpoint = flag.String("trace-endpoint", "",
+	"export spans via OTLP/HTTP to this URL, e.g. http://localhost:4318/v1/traces")
+var traceService = flag.String("trace-service-name", "proxy",
+	"service.name of exported spans")
+var harPath = flag.String("har", "",
+	"record requests to this HTTP Archive (HAR 1.2) file, truncated at startup")
+var harHosts stringsFlag
+var harBodyLimit = flag.Int("har-body-limit", 0,
+	"bytes of each request and response body kept in -har, 0 to omit bodies")
+var recordDir = flag.String("record", "",
+	"store upstream exchanges in this directory, to be served by -replay")
+var replayDir = flag.String("replay", "",
+	"answer requests from exchanges stored by -record, without dialing")
+var fixtureHeaders stringsFlag
+var replayMiss = flag.String("replay-miss", "fail",
+	"for -replay requests not recorded: \"fail\" with 502 or \"pass\" them to the server")
+var cacheSize = flag.String("cache-size", "0",
+	"memory for cached GET responses, e.g. 256m, 0 to disable caching")
+var cacheMaxObject = flag.String("cache-max-object", "8m",
+	"largest response body cached in memory")
+var cacheDir = flag.String("cache-dir", "",
+	"directory for cached responses over -cache-max-object, kept across restarts")
+var cacheDiskSize = flag.String("cache-disk-size", "10g",
+	"disk space for -cache-dir")
+var cacheDiskMaxObject = flag.String("cache-disk-max-object", "1g",
+	"largest response body cached in -cache-dir")
+var shutdownGrace = flag.Duration("shutdown-grace", 30*time.Second,
+	"time given to active requests to finish on shutdown")
 
-func handle(conn net.Conn) {
-	worker := NewWorker()
-	worker.Start(conn)
+func init() {
+	flag.IntVar(&headerLimits.MaxLineLength, "max-request-line",
+		DefaultHeaderLimits.MaxLineLength, "max request/status line length in bytes")
+	flag.IntVar(&headerLimits.MaxFieldLength, "max-header-field",
+		DefaultHeaderLimits.MaxFieldLength, "max length of a header field in bytes")
+	flag.IntVar(&headerLimits.MaxHeaderBytes, "max-header-bytes",
+		DefaultHeaderLimits.MaxHeaderBytes, "max total header bytes")
+	flag.IntVar(&headerLimits.MaxFieldCount, "max-header-count",
+		DefaultHeaderLimits.MaxFieldCount, "max number of header fields")
+
+	flag.DurationVar(&timeouts.Dial, "dial-timeout",
+		DefaultTimeouts.Dial, "timeout for connecting to a server")
+	flag.DurationVar(&timeouts.ClientHeader, "header-timeout",
+		DefaultTimeouts.ClientHeader, "timeout for reading request headers")
+	flag.DurationVar(&timeouts.FirstByte, "first-byte-timeout",
+		DefaultTimeouts.FirstByte, "timeout for receiving response headers")
+	flag.DurationVar(&timeouts.BodyIdle, "idle-timeout",
+		DefaultTimeouts.BodyIdle, "max idle time while transferring a body")
+	flag.DurationVar(&timeouts.Total, "request-timeout",
+		DefaultTimeouts.Total, "max lifetime of a request (0 for no limit)")
+
+	flag.IntVar(&connLimits.MaxTotal, "max-conns",
+		DefaultConnLimits.MaxTotal, "max concurrent connections (0 for no limit)")
+	flag.IntVar(&connLimits.MaxPerClient, "max-conns-per-client",
+		DefaultConnLimits.MaxPerClient, "max concurrent connections per client IP (0 for no limit)")
+	flag.DurationVar(&connLimits.QueueTimeout, "conn-queue-timeout",
+		DefaultConnLimits.QueueTimeout, "how long excess connections wait (0 to refuse immediately)")
+	flag.DurationVar(&connLimits.RetryAfter, "retry-after",
+		DefaultConnLimits.RetryAfter, "Retry-After sent with 503 on refused connections")
+
+	flag.Var(rateLimitFlag{rateLimits}, "rate-limit",
+		"bandwidth limit as SCOPE[:KEY]=RATE[/BURST] where SCOPE is client, user or host,\n"+
+			"e.g. client=1m or host:example.com=100k/1m (repeatable)")
+	flag.Var(networkProfileFlag{networkEmulation}, "network-profile",
+		"emulate a network as client:IP=PROFILE or host:HOST=PROFILE,\n"+
+			"PROFILE is one of 3g, satellite or lossy (repeatable)")
+
+	flag.Var(aclFlag{accessControl}, "acl",
+		"access rule such as \"deny client=10.0.0.0/8 host=.internal port=22 method=POST\",\n"+
+			"evaluated in order, first match wins (repeatable)")
+	flag.Var(aclDefaultFlag{accessControl}, "acl-default", "allow or deny when no -acl rule matches")
+
+	flag.Var(blockRangeFlag{destinationGuard}, "block-range",
+		"refuse destinations resolving into this CIDR, or \"private\" for\n"+
+			"loopback, link-local and private ranges (repeatable)")
+	flag.Var(exemptFlag{destinationGuard}, "block-exempt",
+		"host pattern allowed to resolve into blocked ranges (repeatable)")
+	flag.StringVar(&authRealm, "auth-realm", authRealm, "realm sent in Proxy-Authenticate")
+	flag.StringVar(&jwtValidation.Issuer, "jwt-issuer", "", "required JWT issuer (iss)")
+	flag.StringVar(&jwtValidation.Audience, "jwt-audience", "", "required JWT audience (aud)")
+	flag.StringVar(&jwtValidation.UserClaim, "jwt-user-claim",
+		DefaultJWTValidation.UserClaim, "JWT claim used as user name")
+	flag.StringVar(&jwtValidation.GroupsClaim, "jwt-groups-claim",
+		DefaultJWTValidation.GroupsClaim, "JWT claim listing groups of the user")
+	flag.DurationVar(&jwtValidation.Leeway, "jwt-leeway",
+		DefaultJWTValidation.Leeway, "allowed clock skew for JWT exp and nbf")
+
+	flag.Var(logLevelFlag{}, "log-level", "debug, info, warn or error")
+	flag.Var(&debugHosts, "debug-host",
+		"log debug lines for requests to hosts matching this pattern (repeatable)")
+
+	flag.Var(&harHosts, "har-host",
+		"only record requests to hosts matching this pattern in -har (repeatable)")
+
+	flag.Var(&fixtureHeaders, "fixture-header",
+		"request header telling apart -record exchanges besides method, URL and body (repeatable)")
+
+	flag.Var(&blocklistPaths, "blocklist",
+		"hosts file or domain list of domains to block, reloaded on change (repeatable)")
 }
 
-func serve() {
+// How often credential files, blocklists and the configuration file are
+// checked for changes.
+var authReloadInterval = 5 * time.Second
+
+func serve() int {
 	flag.Parse()
-	ln, err := net.Listen("tcp", ":"+*port)
+	var auths multiAuthenticator
+	if *htpasswdPath != "" {
+		f, err := newHtpasswdFile(*htpasswdPath)
+		if err != nil {
+			logger.Errorf("failed to load htpasswd: %v", err)
+			return 1
+		}
+		go f.watch(authReloadInterval, nil)
+		auths = append(auths, NewBasicAuthenticator(f, authRealm))
+	}
+	if *jwksPath != "" {
+		f, err := newJWKSFile(*jwksPath)
+		if err != nil {
+			logger.Errorf("failed to load JWKS: %v", err)
+			return 1
+		}
+		go f.watch(authReloadInterval, nil)
+		auths = append(auths, NewBearerAuthenticator(f, jwtValidation, authRealm))
+	}
+	if len(auths) > 0 {
+		proxyAuth = auths
+	}
+	if len(blocklistPaths) > 0 {
+		b, err := NewBlocklist(blocklistPaths)
+		if err != nil {
+			logger.Errorf("failed to load blocklist: %v", err)
+			return 1
+		}
+		if *sinkholeStatus != 0 {
+			var body []byte
+			if *sinkholeBody != "" {
+				if body, err = os.ReadFile(*sinkholeBody); err != nil {
+					logger.Errorf("failed to read sinkhole body: %v", err)
+					return 1
+				}
+			}
+			if b.Sinkhole, err = newSinkholeResponse(*sinkholeStatus, *sinkholeType, body); err != nil {
+				logger.Errorf("%v", err)
+				return 1
+			}
+			b.SinkholeBody = body
+		}
+		go b.watch(authReloadInterval, nil)
+		blocklist = b
+	}
+
+	format, err := parseAccessLogFormat(*accessLogFormat)
 	if err != nil {
-		panic(err)
+		logger.Errorf("%v", err)
+		return 1
+	}
+	if err := accessLog.Open(*accessLogPath, format); err != nil {
+		logger.Errorf("failed to open access log: %v", err)
+		return 1
+	}
+	if *traceEndpoint != "" {
+		if u, err := url.Parse(*traceEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			logger.Errorf("invalid -trace-endpoint: %s", *traceEndpoint)
+			return 1
+		}
+		spanExporter = NewSpanExporter(*traceEndpoint, *traceService)
+		defer spanExporter.Close()
+	}
+	size, err := parseByteSize(*cacheSize)
+	if err != nil {
+		logger.Errorf("invalid -cache-size: %v", err)
+		return 1
+	}
+	maxObject, err := parseByteSize(*cacheMaxObject)
+	if err != nil {
+		logger.Errorf("invalid -cache-max-object: %v", err)
+		return 1
+	}
+	var disk *diskStore
+	if *cacheDir != "" {
+		diskSize, err := parseByteSize(*cacheDiskSize)
+		if err != nil {
+			logger.Errorf("invalid -cache-disk-size: %v", err)
+			return 1
+		}
+		diskMaxObject, err := parseByteSize(*cacheDiskMaxObject)
+		if err != nil {
+			logger.Errorf("invalid -cache-disk-max-object: %v", err)
+			return 1
+		}
+		if disk, err = openDiskStore(*cacheDir, diskSize, diskMaxObject); err != nil {
+			logger.Errorf("opening -cache-dir: %v", err)
+			return 1
+		}
+	}
+	if size > 0 || disk != nil {
+		responseCache = NewCache(newMemoryStore(size), disk, maxObject)
+	}
+	if *recordDir != "" || *replayDir != "" {
+		if *recordDir != "" && *replayDir != "" {
+			logger.Errorf("-record and -replay are exclusive")
+			return 1
+		}
+		if *replayMiss != "fail" && *replayMiss != "pass" {
+			logger.Errorf("invalid -replay-miss: %s", *replayMiss)
+			return 1
+		}
+		dir, mode := *recordDir, FixtureRecord
+		if *replayDir != "" {
+			dir, mode = *replayDir, FixtureReplay
+		}
+		s, err := NewFixtureStore(dir, mode, fixtureHeaders, *replayMiss == "pass")
+		if err != nil {
+			logger.Errorf("failed to open fixtures: %v", err)
+			return 1
+		}
+		fixtures = s
+	}
+	if *harPath != "" {
+		h, err := OpenHARRecorder(*harPath, harHosts, *harBodyLimit)
+		if err != nil {
+			logger.Errorf("failed to open HAR file: %v", err)
+			return 1
+		}
+		harRecorder = h
+		defer h.Close()
+	}
+
+	addrs := []string{":" + *port}
+	var config *configFile
+	if *configPath != "" {
+		f, c, err := newConfigFile(*configPath)
+		if err != nil {
+			logger.Errorf("failed to load config: %v", err)
+			return 1
+		}
+		if len(c.Listen) > 0 {
+			addrs = c.Listen
+		}
+		if c.MetricsListen != "" {
+			*metricsAddr = c.MetricsListen
+		}
+		if c.AdminListen != "" {
+			*adminAddr = c.AdminListen
+		}
+		config = f
 	}
-	defer ln.Close()
 
-	for {
-		conn, err := ln.Accept()
+	var lns []net.Listener
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
 		if err != nil {
-			log.Printf("E accept error: %v", err)
-			continue
+			panic(err)
 		}
-		log.Printf("I accept conn: %v", conn)
-		go handle(conn)
+		lns = append(lns, ln)
+	}
+	if *metricsAddr != "" {
+		ln, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			if err := serveMetrics(ln, metrics); err != nil {
+				logger.Errorf("metrics: %v", err)
+			}
+		}()
+		defer ln.Close()
+	}
+
+	srv := NewServer()
+	var reload func() error
+	if config != nil {
+		config.installed = func(s *Settings) { srv.limiter.setLimits(s.ConnLimits) }
+		go config.watch(authReloadInterval, nil)
+		reload = config.Reload
+	}
+	if *adminAddr != "" {
+		if *adminTokenFile == "" {
+			logger.Errorf("-admin-addr requires -admin-token-file")
+			return 1
+		}
+		token, err := readAdminToken(*adminTokenFile)
+		if err != nil {
+			logger.Errorf("failed to read admin token: %v", err)
+			return 1
+		}
+		ln, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			if err := serveHTTP(ln, NewAdminAPI(srv, token, reload)); err != nil {
+				logger.Errorf("admin: %v", err)
+			}
+		}()
+		defer ln.Close()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	go func() {
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				if config == nil {
+					logger.Warnf("SIGHUP received without -config, ignored")
+				} else if err := config.Reload(); err != nil {
+					logger.Errorf("config: reload failed, keeping previous: %v", err)
+				}
+				continue
+			}
+			logger.Infof("%v received, shutting down", sig)
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, ln := range lns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.Serve(ln)
+		}()
+	}
+	wg.Wait()
+	if !srv.Drain(*shutdownGrace) {
+		return 1
 	}
+	return 0
 }
 
 func main() {
-	serve()
+	os.Exit(serve())
 }
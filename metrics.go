@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metricVec is a Prometheus counter or gauge with optional labels.
+type metricVec struct {
+	name   string
+	help   string
+	typ    string // "counter" or "gauge"
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64 // keyed by label values joined with 0xff
+}
+
+func newMetricVec(typ, name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: typ, labels: labels,
+		values: make(map[string]float64)}
+}
+
+// add adds |d| to the series with |values| for the labels.
+func (v *metricVec) add(d float64, values ...string) {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("%s: got %d label values, want %d", v.name, len(values), len(v.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[key] += d
+}
+
+func (v *metricVec) inc(values ...string) {
+	v.add(1, values...)
+}
+
+func (v *metricVec) get(values ...string) float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.values[strings.Join(values, "\xff")]
+}
+
+func (v *metricVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+	if len(v.labels) == 0 && len(v.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", v.name)
+		return
+	}
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name,
+			formatLabels(v.labels, strings.Split(k, "\xff")), formatValue(v.values[k]))
+	}
+}
+
+// histogram is a Prometheus histogram without labels.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64 // upper bounds, ascending
+	mu      sync.Mutex
+	counts  []uint64 // per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+// Buckets in seconds for latencies of network round trips.
+var latencyBuckets = []float64{
+	0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60,
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets,
+		counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(b), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatValue(h.sum), h.name, h.count)
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, n := range names {
+		parts[i] = n + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Metrics collected by servers and workers.
+type Metrics struct {
+	ConnsAccepted    *metricVec
+	ConnsActive      *metricVec
+	ConnLimitEvents  *metricVec // by limit, "total" or "client", and outcome, "queued" or "rejected"
+	Requests         *metricVec // by method and status
+	Bytes            *metricVec // by direction, "in" from clients and "out" to clients
+	Errors           *metricVec // by stage
+	WorkerStates     *metricVec // workers in each state
+	CacheLookups     *metricVec // by result, see Cache.lookup
+	CacheBytes       *metricVec
+	DialSeconds      *histogram
+	FirstByteSeconds *histogram
+}
+
+// Stages of Metrics.Errors.
+const (
+	StageRequestRead  = "request_read"
+	StageDial         = "dial"
+	StageResponseRead = "response_read"
+	StageBodyTransfer = "body_transfer"
+)
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ConnsAccepted: newMetricVec("counter", "proxy_connections_accepted_total",
+			"Connections accepted."),
+		ConnsActive: newMetricVec("gauge", "proxy_connections_active",
+			"Connections currently handled by a worker."),
+		ConnLimitEvents: newMetricVec("counter", "proxy_connection_limit_events_total",
+			"Connections over a limit by limit and outcome.", "limit", "outcome"),
+		Requests: newMetricVec("counter", "proxy_requests_total",
+			"Completed requests by method and response status.", "method", "status"),
+		Bytes: newMetricVec("counter", "proxy_body_bytes_total",
+			"Body bytes relayed, \"in\" from clients and \"out\" to clients.", "direction"),
+		Errors: newMetricVec("counter", "proxy_errors_total",
+			"Errors by the stage they occurred in.", "stage"),
+		WorkerStates: newMetricVec("gauge", "proxy_worker_states",
+			"Workers currently in each state.", "state"),
+		CacheLookups: newMetricVec("counter", "proxy_cache_lookups_total",
+			"Cache lookups of GET and HEAD requests by result.", "result"),
+		CacheBytes: newMetricVec("gauge", "proxy_cache_bytes",
+			"Approximate size of the cached responses by tier, \"memory\" or \"disk\".", "tier"),
+		DialSeconds: newHistogram("proxy_upstream_dial_seconds",
+			"Time to connect to the upstream server.", latencyBuckets),
+		FirstByteSeconds: newHistogram("proxy_upstream_first_byte_seconds",
+			"Time from sending the request to receiving the response header.", latencyBuckets),
+	}
+}
+
+// Shared by all servers and workers.
+var metrics = NewMetrics()
+
+// WriteText writes all metrics in the Prometheus text format.
+func (m *Metrics) WriteText(w io.Writer) {
+	for _, v := range []*metricVec{m.ConnsAccepted, m.ConnsActive, m.ConnLimitEvents,
+		m.Requests, m.Bytes, m.Errors, m.WorkerStates, m.CacheLookups, m.CacheBytes} {
+		v.writeTo(w)
+	}
+	m.DialSeconds.writeTo(w)
+	m.FirstByteSeconds.writeTo(w)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+// serveMetrics serves /metrics on |ln| until it is closed.
+func serveMetrics(ln net.Listener, m *Metrics) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	return serveHTTP(ln, mux)
+}
+
+// serveHTTP serves |h| on |ln| until it is closed.
+func serveHTTP(ln net.Listener, h http.Handler) error {
+	err := http.Serve(ln, h)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// methodLabel limits the label values of request methods to known ones.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH":
+		return method
+	}
+	return "OTHER"
+}
+
+var stateNames sync.Map // function pointer -> name
+
+// stateName returns the name of the state function, e.g. "waitForRequest".
+func stateName(f stateFunc) string {
+	pc := reflect.ValueOf(f).Pointer()
+	if name, ok := stateNames.Load(pc); ok {
+		return name.(string)
+	}
+	name := runtime.FuncForPC(pc).Name()
+	name = name[strings.LastIndexByte(name, '.')+1:]
+	stateNames.Store(pc, name)
+	return name
+}
+
+// countingWriter adds the number of written bytes to a metric and to
+// |total|.
+type countingWriter struct {
+	w         io.Writer
+	direction string
+	total     *atomic.Int64
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	metrics.Bytes.add(float64(n), c.direction)
+	c.total.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsText(t *testing.T) {
+	v := newMetricVec("counter", "test_total", "Test.", "method", "status")
+	v.inc("GET", "200")
+	v.add(2, "POST", "say \"hi\"")
+	h := newHistogram("test_seconds", "Latency.", []float64{0.1, 1})
+	h.observe(0.05)
+	h.observe(0.5)
+	h.observe(3)
+
+	var b bytes.Buffer
+	v.writeTo(&b)
+	h.writeTo(&b)
+	ExpectEqual(t, `# HELP test_total Test.
+# TYPE test_total counter
+test_total{method="GET",status="200"} 1
+test_total{method="POST",status="say \"hi\""} 2
+# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 3.55
+test_seconds_count 3
+`, b.String())
+}
+
+func TestWorkerMetrics(t *testing.T) {
+	saved := metrics
+	defer func() { metrics = saved }()
+	metrics = NewMetrics()
+
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, c)
+		go io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nFooBar")
+		return s, nil
+	}
+	client, finished := runWorkerOnPipe(Timeouts{})
+	client.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	io.ReadAll(client)
+	<-finished
+
+	ExpectEqual(t, "1 5 6 1 1", fmt.Sprint(
+		metrics.Requests.get("POST", "200"),
+		metrics.Bytes.get("in"), metrics.Bytes.get("out"),
+		metrics.DialSeconds.count, metrics.FirstByteSeconds.count))
+	for _, state := range []string{"waitForRequest", "waitForResponse", "receiveBody", "finishWorker"} {
+		ExpectEqual(t, "0", fmt.Sprint(metrics.WorkerStates.get(state)))
+	}
+
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		return nil, fmt.Errorf("refused")
+	}
+	client, finished = runWorkerOnPipe(Timeouts{})
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	readStatusLineWithin(t, client, time.Second)
+	<-finished
+	ExpectEqual(t, "1 1", fmt.Sprint(metrics.Errors.get(StageDial), metrics.Requests.get("GET", "400")))
+}
+
+func TestServeMetrics(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	m.ConnsAccepted.inc()
+	done := make(chan error)
+	go func() { done <- serveMetrics(ln, m) }()
+
+	res, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(body), "\nproxy_connections_accepted_total 1\n") {
+		t.Errorf("unexpected metrics:\n%s", body)
+	}
+	ln.Close()
+	if err := <-done; err != nil {
+		t.Errorf("serveMetrics: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NetworkProfile describes a degraded network to emulate. Zero fields
+// leave that aspect untouched.
+type NetworkProfile struct {
+	Latency          time.Duration // added once per request before dialing
+	BytesPerSec      int64         // throughput cap per request
+	Jitter           time.Duration // random delay up to this before each chunk
+	StallProbability float64       // chance of stalling before a chunk
+	StallDuration    time.Duration
+	ResetProbability float64 // chance of resetting the connections before a chunk
+}
+
+var builtinNetworkProfiles = map[string]NetworkProfile{
+	"3g": {
+		Latency:     100 * time.Millisecond,
+		BytesPerSec: 94 * 1000,
+		Jitter:      20 * time.Millisecond,
+	},
+	"satellite": {
+		Latency:     600 * time.Millisecond,
+		BytesPerSec: 125 * 1000,
+		Jitter:      50 * time.Millisecond,
+	},
+	"lossy": {
+		Latency:          50 * time.Millisecond,
+		Jitter:           200 * time.Millisecond,
+		StallProbability: 0.01,
+		StallDuration:    2 * time.Second,
+		ResetProbability: 0.001,
+	},
+}
+
+// networkEmulator selects a profile for a request by client IP first and
+// then by destination host.
+type networkEmulator struct {
+	mu       sync.Mutex
+	profiles map[string]NetworkProfile
+	byClient map[string]string
+	byHost   map[string]string
+}
+
+func newNetworkEmulator() *networkEmulator {
+	e := &networkEmulator{
+		profiles: make(map[string]NetworkProfile),
+		byClient: make(map[string]string),
+		byHost:   make(map[string]string),
+	}
+	for name, p := range builtinNetworkProfiles {
+		e.profiles[name] = p
+	}
+	return e
+}
+
+// Shared by all workers.
+var networkEmulation = newNetworkEmulator()
+
+// DefineProfile adds or replaces a named profile.
+func (e *networkEmulator) DefineProfile(name string, p NetworkProfile) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.profiles[name] = p
+}
+
+// ProfileScope is what network profiles are assigned by.
+type ProfileScope string
+
+const (
+	ProfileScopeClient ProfileScope = "client" // client IP
+	ProfileScopeHost   ProfileScope = "host"   // destination host
+)
+
+// Assign selects profile |name| for a client IP or a destination host.
+// An empty name removes the assignment.
+func (e *networkEmulator) Assign(scope ProfileScope, key, name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var m map[string]string
+	switch scope {
+	case ProfileScopeClient:
+		m = e.byClient
+	case ProfileScopeHost:
+		m = e.byHost
+	default:
+		return fmt.Errorf("Network profiles can't be assigned by %s", scope)
+	}
+	if name == "" {
+		delete(m, key)
+		return nil
+	}
+	if _, ok := e.profiles[name]; !ok {
+		return fmt.Errorf("Unknown network profile: %s", name)
+	}
+	m[key] = name
+	return nil
+}
+
+func (e *networkEmulator) profileFor(client, host string) (NetworkProfile, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	name, ok := e.byClient[client]
+	if !ok {
+		name, ok = e.byHost[host]
+	}
+	if !ok {
+		return NetworkProfile{}, false
+	}
+	p, ok := e.profiles[name]
+	return p, ok
+}
+
+var errEmulatedReset = errors.New("Connection reset by network emulation")
+
+// emulatedWriter applies jitter, stalls and resets of a profile to every
+// chunk written.
+type emulatedWriter struct {
+	w       io.Writer
+	profile NetworkProfile
+	done    <-chan struct{}
+	reset   func()
+	random  func() float64
+}
+
+func newEmulatedWriter(w io.Writer, p NetworkProfile,
+	done <-chan struct{}, reset func()) *emulatedWriter {
+	return &emulatedWriter{w, p, done, reset, rand.Float64}
+}
+
+func (w *emulatedWriter) sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-w.done:
+		return fmt.Errorf("Emulated write canceled")
+	}
+}
+
+func (w *emulatedWriter) Write(b []byte) (int, error) {
+	p := w.profile
+	if p.ResetProbability > 0 && w.random() < p.ResetProbability {
+		w.reset()
+		return 0, errEmulatedReset
+	}
+	delay := time.Duration(w.random() * float64(p.Jitter))
+	if p.StallProbability > 0 && w.random() < p.StallProbability {
+		delay += p.StallDuration
+	}
+	if err := w.sleep(delay); err != nil {
+		return 0, err
+	}
+	return w.w.Write(b)
+}
+
+// resetConn closes |conn| so that the peer sees a TCP RST if possible.
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// networkProfileFlag accepts "client:IP=PROFILE" or "host:HOST=PROFILE".
+type networkProfileFlag struct {
+	e *networkEmulator
+}
+
+func (f networkProfileFlag) String() string {
+	return ""
+}
+
+func (f networkProfileFlag) Set(s string) error {
+	target, name, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("Missing '=' in %s", s)
+	}
+	scope, key, ok := strings.Cut(target, ":")
+	if !ok {
+		return fmt.Errorf("Missing ':' in %s", s)
+	}
+	return f.e.Assign(ProfileScope(scope), key, name)
+}
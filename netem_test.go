@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestNetworkEmulatorProfileFor(t *testing.T) {
+	e := newNetworkEmulator()
+	f := networkProfileFlag{e}
+	if err := f.Set("host:example.com=satellite"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("client:10.0.0.1=3g"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"host:example.com=bogus", "user:bob=3g", "3g"} {
+		if err := f.Set(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+
+	p, ok := e.profileFor("10.0.0.1", "example.com")
+	if !ok || p != builtinNetworkProfiles["3g"] {
+		t.Errorf("client profile should win: %v", p)
+	}
+	p, ok = e.profileFor("10.0.0.2", "example.com")
+	if !ok || p != builtinNetworkProfiles["satellite"] {
+		t.Errorf("got %v, want satellite", p)
+	}
+	if _, ok := e.profileFor("10.0.0.2", "example.org"); ok {
+		t.Errorf("unexpected profile")
+	}
+}
+
+func TestEmulatedWriterReset(t *testing.T) {
+	reset := false
+	w := newEmulatedWriter(new(bytes.Buffer), NetworkProfile{ResetProbability: 0.5},
+		make(chan struct{}), func() { reset = true })
+	w.random = func() float64 { return 0.1 }
+	if _, err := w.Write([]byte("foo")); err != errEmulatedReset || !reset {
+		t.Errorf("expected reset, got %v", err)
+	}
+}
+
+func TestEmulatedWriterStall(t *testing.T) {
+	buf := new(bytes.Buffer)
+	p := NetworkProfile{
+		Jitter:           10 * time.Millisecond,
+		StallProbability: 0.5,
+		StallDuration:    50 * time.Millisecond,
+	}
+	w := newEmulatedWriter(buf, p, make(chan struct{}), func() {})
+	w.random = func() float64 { return 0.1 }
+
+	start := time.Now()
+	if _, err := w.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 51*time.Millisecond {
+		t.Errorf("write finished too early: %v", elapsed)
+	}
+	ExpectEqual(t, "foo", buf.String())
+
+	w.random = func() float64 { return 0.9 }
+	start = time.Now()
+	w.Write([]byte("bar"))
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("unexpected stall: %v", elapsed)
+	}
+}
@@ -35,6 +35,54 @@ var ResponseBadRequest = &Response{
 	Phrase:  "Bad Request",
 }
 
+var ResponseForbidden = &Response{
+	Version: "HTTP/1.1",
+	Status:  403,
+	Phrase:  "Forbidden",
+}
+
+var ResponseConnectionEstablished = &Response{
+	Version: "HTTP/1.1",
+	Status:  200,
+	Phrase:  "Connection Established",
+}
+
+var ResponseBadGateway = &Response{
+	Version: "HTTP/1.1",
+	Status:  502,
+	Phrase:  "Bad Gateway",
+}
+
+var ResponseRequestTimeout = &Response{
+	Version: "HTTP/1.1",
+	Status:  408,
+	Phrase:  "Request Timeout",
+}
+
+var ResponseGatewayTimeout = &Response{
+	Version: "HTTP/1.1",
+	Status:  504,
+	Phrase:  "Gateway Timeout",
+}
+
+var ResponseURITooLong = &Response{
+	Version: "HTTP/1.1",
+	Status:  414,
+	Phrase:  "URI Too Long",
+}
+
+var ResponseHeaderFieldsTooLarge = &Response{
+	Version: "HTTP/1.1",
+	Status:  431,
+	Phrase:  "Request Header Fields Too Large",
+}
+
+var ResponseContentTooLarge = &Response{
+	Version: "HTTP/1.1",
+	Status:  413,
+	Phrase:  "Content Too Large",
+}
+
 func RemoveHopByHopHeaders(h HTTPHeader) {
 	delete(h, "connection")
 	delete(h, "keep-alive")
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket limit in bytes. Zero BytesPerSec means no
+// limit. Burst defaults to one second worth of bytes.
+type RateLimit struct {
+	BytesPerSec int64
+	Burst       int64
+}
+
+func (l RateLimit) burst() int64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.BytesPerSec
+}
+
+// A rate limit applies to all connections sharing the same key within a
+// scope, and to body bytes in both directions.
+type RateScope string
+
+const (
+	RateScopeClient RateScope = "client" // client IP
+	RateScopeUser   RateScope = "user"   // authenticated user name
+	RateScopeHost   RateScope = "host"   // destination host
+)
+
+var rateScopes = []RateScope{RateScopeClient, RateScopeUser, RateScopeHost}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+	refs   int // guarded by rateLimiter.mu
+}
+
+func newTokenBucket(l RateLimit) *tokenBucket {
+	return &tokenBucket{limit: l, tokens: float64(l.burst()), last: time.Now()}
+}
+
+func (b *tokenBucket) setLimit(l RateLimit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.limit = l
+	if max := float64(l.burst()); b.tokens > max {
+		b.tokens = max
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.limit.BytesPerSec)
+	if max := float64(b.limit.burst()); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// reserve takes n tokens, possibly going into debt, and returns how long
+// the caller has to wait until the debt is paid off.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit.BytesPerSec <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.limit.BytesPerSec) * float64(time.Second))
+}
+
+func (b *tokenBucket) maxChunk() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int(b.limit.burst())
+}
+
+type bucketKey struct {
+	scope RateScope
+	key   string
+}
+
+// rateLimiter holds the configured limits and the buckets in use. Limits
+// can be changed at any time and take effect on running transfers.
+type rateLimiter struct {
+	mu        sync.Mutex
+	defaults  map[RateScope]RateLimit
+	overrides map[bucketKey]RateLimit
+	buckets   map[bucketKey]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		defaults:  make(map[RateScope]RateLimit),
+		overrides: make(map[bucketKey]RateLimit),
+		buckets:   make(map[bucketKey]*tokenBucket),
+	}
+}
+
+// Shared by all workers.
+var rateLimits = newRateLimiter()
+
+func (r *rateLimiter) limitFor(k bucketKey) RateLimit {
+	if l, ok := r.overrides[k]; ok {
+		return l
+	}
+	return r.defaults[k.scope]
+}
+
+// SetDefault sets the limit for keys in |scope| without an override.
+func (r *rateLimiter) SetDefault(scope RateScope, l RateLimit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.defaults[scope] = l
+	for k, b := range r.buckets {
+		if k.scope == scope {
+			b.setLimit(r.limitFor(k))
+		}
+	}
+}
+
+// SetLimit overrides the limit for a single key.
+func (r *rateLimiter) SetLimit(scope RateScope, key string, l RateLimit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := bucketKey{scope, key}
+	r.overrides[k] = l
+	if b, ok := r.buckets[k]; ok {
+		b.setLimit(l)
+	}
+}
+
+// ClearLimit removes an override set by SetLimit.
+func (r *rateLimiter) ClearLimit(scope RateScope, key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := bucketKey{scope, key}
+	delete(r.overrides, k)
+	if b, ok := r.buckets[k]; ok {
+		b.setLimit(r.limitFor(k))
+	}
+}
+
+// acquire returns the buckets for the given keys. Empty keys are skipped.
+// Buckets are created even if currently unlimited, so that a limit set
+// later applies to running transfers. Must be paired with release.
+func (r *rateLimiter) acquire(client, user, host string) []bucketKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var keys []bucketKey
+	for i, key := range []string{client, user, host} {
+		if key == "" {
+			continue
+		}
+		k := bucketKey{rateScopes[i], key}
+		b, ok := r.buckets[k]
+		if !ok {
+			b = newTokenBucket(r.limitFor(k))
+			r.buckets[k] = b
+		}
+		b.refs++
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (r *rateLimiter) release(keys []bucketKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range keys {
+		if b, ok := r.buckets[k]; ok {
+			if b.refs--; b.refs <= 0 {
+				delete(r.buckets, k)
+			}
+		}
+	}
+}
+
+// rateConfig is a complete set of limits of a rateLimiter.
+type rateConfig struct {
+	defaults  map[RateScope]RateLimit
+	overrides map[bucketKey]RateLimit
+}
+
+// config returns a copy of the current limits.
+func (r *rateLimiter) config() rateConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := rateConfig{
+		defaults:  make(map[RateScope]RateLimit, len(r.defaults)),
+		overrides: make(map[bucketKey]RateLimit, len(r.overrides)),
+	}
+	for k, l := range r.defaults {
+		c.defaults[k] = l
+	}
+	for k, l := range r.overrides {
+		c.overrides[k] = l
+	}
+	return c
+}
+
+// Configure replaces all limits at once, including those of buckets in use.
+func (r *rateLimiter) Configure(c rateConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.defaults = c.defaults
+	r.overrides = c.overrides
+	for k, b := range r.buckets {
+		b.setLimit(r.limitFor(k))
+	}
+}
+
+func (r *rateLimiter) bucketsFor(keys []bucketKey) []*tokenBucket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bs := make([]*tokenBucket, 0, len(keys))
+	for _, k := range keys {
+		bs = append(bs, r.buckets[k])
+	}
+	return bs
+}
+
+// rateLimitedWriter delays writes so that they fit in all of its buckets.
+type rateLimitedWriter struct {
+	w       io.Writer
+	buckets []*tokenBucket
+	done    <-chan struct{}
+}
+
+func newRateLimitedWriter(
+	w io.Writer, buckets []*tokenBucket, done <-chan struct{}) io.Writer {
+	if len(buckets) == 0 {
+		return w
+	}
+	return &rateLimitedWriter{w, buckets, done}
+}
+
+func (w *rateLimitedWriter) chunkSize(n int) int {
+	for _, b := range w.buckets {
+		if m := b.maxChunk(); m > 0 && m < n {
+			n = m
+		}
+	}
+	return n
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := w.chunkSize(len(p) - written)
+		var wait time.Duration
+		for _, b := range w.buckets {
+			if d := b.reserve(n); d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-w.done:
+				t.Stop()
+				return written, fmt.Errorf("Rate limited write canceled")
+			}
+		}
+		m, err := w.w.Write(p[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+var byteUnits = map[byte]int64{
+	'k': 1000,
+	'm': 1000 * 1000,
+	'g': 1000 * 1000 * 1000,
+}
+
+// parseByteSize parses sizes like "512", "64k" or "10m".
+func parseByteSize(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, fmt.Errorf("Invalid size")
+	}
+	m, ok := byteUnits[strings.ToLower(s[len(s)-1:])[0]]
+	if ok {
+		s = s[:len(s)-1]
+	} else {
+		m = 1
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size: %s", s)
+	}
+	if n > math.MaxInt64/m {
+		return 0, fmt.Errorf("Size too large: %s", s)
+	}
+	return n * m, nil
+}
+
+// parseRateLimit parses "RATE[/BURST]" such as "1m/4m".
+func parseRateLimit(s string) (RateLimit, error) {
+	rate, burst, hasBurst := strings.Cut(s, "/")
+	var l RateLimit
+	var err error
+	if l.BytesPerSec, err = parseByteSize(rate); err != nil {
+		return l, err
+	}
+	if hasBurst {
+		if l.Burst, err = parseByteSize(burst); err != nil {
+			return l, err
+		}
+	}
+	return l, nil
+}
+
+// rateLimitFlag accepts "SCOPE=RATE[/BURST]" for a scope default, or
+// "SCOPE:KEY=RATE[/BURST]" for a single key, e.g. "client:10.0.0.5=100k".
+type rateLimitFlag struct {
+	r *rateLimiter
+}
+
+func (f rateLimitFlag) String() string {
+	return ""
+}
+
+func (f rateLimitFlag) Set(s string) error {
+	k, hasKey, l, err := parseRateLimitRule(s)
+	if err != nil {
+		return err
+	}
+	if hasKey {
+		f.r.SetLimit(k.scope, k.key, l)
+	} else {
+		f.r.SetDefault(k.scope, l)
+	}
+	return nil
+}
+
+// parseRateLimitRule parses the -rate-limit syntax. k.key is only
+// meaningful if hasKey is true.
+func parseRateLimitRule(s string) (k bucketKey, hasKey bool, l RateLimit, err error) {
+	target, limit, ok := strings.Cut(s, "=")
+	if !ok {
+		return k, false, l, fmt.Errorf("Missing '=' in %s", s)
+	}
+	if l, err = parseRateLimit(limit); err != nil {
+		return k, false, l, err
+	}
+	scope, key, hasKey := strings.Cut(target, ":")
+	if !isRateScope(RateScope(scope)) {
+		return k, false, l, fmt.Errorf("Unknown rate limit scope: %s", scope)
+	}
+	return bucketKey{RateScope(scope), key}, hasKey, l, nil
+}
+
+// add applies a rule in the -rate-limit syntax.
+func (c rateConfig) add(s string) error {
+	k, hasKey, l, err := parseRateLimitRule(s)
+	if err != nil {
+		return err
+	}
+	if hasKey {
+		c.overrides[k] = l
+	} else {
+		c.defaults[k.scope] = l
+	}
+	return nil
+}
+
+func isRateScope(s RateScope) bool {
+	for _, scope := range rateScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hostWithoutPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
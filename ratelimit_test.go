@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(RateLimit{BytesPerSec: 1000, Burst: 500})
+	if d := b.reserve(500); d != 0 {
+		t.Errorf("burst should not wait: %v", d)
+	}
+	d := b.reserve(100)
+	if d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("got wait %v, want about 100ms", d)
+	}
+
+	b.setLimit(RateLimit{})
+	if d := b.reserve(1000000); d != 0 {
+		t.Errorf("unlimited bucket should not wait: %v", d)
+	}
+}
+
+func TestRateLimitedWriter(t *testing.T) {
+	b := newTokenBucket(RateLimit{BytesPerSec: 10000, Burst: 1000})
+	buf := new(bytes.Buffer)
+	w := newRateLimitedWriter(buf, []*tokenBucket{b}, make(chan struct{}))
+
+	start := time.Now()
+	n, err := w.Write(make([]byte, 3000))
+	elapsed := time.Since(start)
+	if n != 3000 || err != nil {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	// 1000 bytes of burst, then 2000 bytes at 10k/s
+	if elapsed < 180*time.Millisecond {
+		t.Errorf("write finished too early: %v", elapsed)
+	}
+}
+
+func TestRateLimitedWriterCanceled(t *testing.T) {
+	b := newTokenBucket(RateLimit{BytesPerSec: 10, Burst: 10})
+	done := make(chan struct{})
+	close(done)
+	w := newRateLimitedWriter(new(bytes.Buffer), []*tokenBucket{b}, done)
+	if _, err := w.Write(make([]byte, 100)); err == nil {
+		t.Errorf("expected error on canceled write")
+	}
+}
+
+func TestRateLimiterRuntimeChange(t *testing.T) {
+	r := newRateLimiter()
+	r.SetDefault(RateScopeClient, RateLimit{BytesPerSec: 100})
+	keys := r.acquire("10.0.0.1", "", "example.com")
+	bs := r.bucketsFor(keys)
+	if len(bs) != 2 {
+		t.Fatalf("got %d buckets, want 2", len(bs))
+	}
+	if bs[0].limit.BytesPerSec != 100 || bs[1].limit.BytesPerSec != 0 {
+		t.Errorf("unexpected limits: %v %v", bs[0].limit, bs[1].limit)
+	}
+
+	r.SetLimit(RateScopeHost, "example.com", RateLimit{BytesPerSec: 50})
+	r.SetDefault(RateScopeClient, RateLimit{BytesPerSec: 200})
+	if bs[0].limit.BytesPerSec != 200 || bs[1].limit.BytesPerSec != 50 {
+		t.Errorf("unexpected limits: %v %v", bs[0].limit, bs[1].limit)
+	}
+	r.ClearLimit(RateScopeHost, "example.com")
+	if bs[1].limit.BytesPerSec != 0 {
+		t.Errorf("override not cleared: %v", bs[1].limit)
+	}
+
+	r.release(keys)
+	if len(r.buckets) != 0 {
+		t.Errorf("buckets not released: %v", r.buckets)
+	}
+}
+
+func TestRateLimitFlag(t *testing.T) {
+	r := newRateLimiter()
+	f := rateLimitFlag{r}
+	if err := f.Set("client=1m/4m"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("host:example.com=64k"); err != nil {
+		t.Fatal(err)
+	}
+	if l := r.defaults[RateScopeClient]; l.BytesPerSec != 1000000 || l.Burst != 4000000 {
+		t.Errorf("unexpected client default: %v", l)
+	}
+	if l := r.overrides[bucketKey{RateScopeHost, "example.com"}]; l.BytesPerSec != 64000 {
+		t.Errorf("unexpected host limit: %v", l)
+	}
+	if n, err := parseByteSize("9223372036854775g"); err == nil {
+		t.Errorf("overflowing size parsed as %d", n)
+	}
+	if n, err := parseByteSize("9223372036g"); err != nil || n != 9223372036000000000 {
+		t.Errorf("largest size in g: %d, %v", n, err)
+	}
+	for _, s := range []string{
+		"client", "bogus=1k", "user=fast", "host=1k/x", "client=99999999999g"} {
+		if err := f.Set(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
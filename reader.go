@@ -2,9 +2,10 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -17,9 +18,43 @@ func toBufioReader(r io.Reader) *bufio.Reader {
 	}
 }
 
+// HeaderLimits bounds how much a peer can make us buffer while reading
+// the start line and header fields of a message.
+type HeaderLimits struct {
+	MaxLineLength  int // request line or status line
+	MaxFieldLength int // a single header field line
+	MaxHeaderBytes int // all header field lines together
+	MaxFieldCount  int
+}
+
+var DefaultHeaderLimits = HeaderLimits{
+	MaxLineLength:  8192,
+	MaxFieldLength: 8192,
+	MaxHeaderBytes: 64 * 1024,
+	MaxFieldCount:  100,
+}
+
+// Used by readers created from now on. Can be overridden by flags.
+var headerLimits = DefaultHeaderLimits
+
+var (
+	ErrLineTooLong        = errors.New("Start line too long")
+	ErrHeaderFieldTooLong = errors.New("Header field too long")
+	ErrHeaderTooLarge     = errors.New("Header too large")
+	ErrTooManyHeaders     = errors.New("Too many header fields")
+)
+
+func isHeaderLimitError(err error) bool {
+	return errors.Is(err, ErrLineTooLong) ||
+		errors.Is(err, ErrHeaderFieldTooLong) ||
+		errors.Is(err, ErrHeaderTooLarge) ||
+		errors.Is(err, ErrTooManyHeaders)
+}
+
 type baseReader struct {
-	r     *bufio.Reader
-	errCh chan error
+	r      *bufio.Reader
+	errCh  chan error
+	limits HeaderLimits
 }
 
 func (r *baseReader) ErrorOccurred() <-chan error {
@@ -27,13 +62,18 @@ func (r *baseReader) ErrorOccurred() <-chan error {
 }
 
 // similar to readLineSlice() in net/textproto/reader.go
-func (r *baseReader) readLine() (string, error) {
+// Returns tooLong as soon as the line grows beyond max bytes (0 means no
+// limit), without buffering the rest of it.
+func (r *baseReader) readLine(max int, tooLong error) (string, error) {
 	var line []byte
 	for {
 		l, more, err := r.r.ReadLine()
 		if err != nil {
 			return "", err
 		}
+		if max > 0 && len(line)+len(l) > max {
+			return "", tooLong
+		}
 		if line == nil && !more {
 			return string(l), nil
 		}
@@ -47,14 +87,27 @@ func (r *baseReader) readLine() (string, error) {
 
 func (r *baseReader) readHeaders() (HTTPHeader, error) {
 	headers := make(map[string]string)
+	total := 0
+	count := 0
 	for {
-		line, err := r.readLine()
+		line, err := r.readLine(r.limits.MaxFieldLength, ErrHeaderFieldTooLong)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to read headers")
+			if isHeaderLimitError(err) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Failed to read headers: %w", err)
 		}
 		if len(line) == 0 {
 			break
 		}
+		total += len(line)
+		count++
+		if r.limits.MaxHeaderBytes > 0 && total > r.limits.MaxHeaderBytes {
+			return nil, ErrHeaderTooLarge
+		}
+		if r.limits.MaxFieldCount > 0 && count > r.limits.MaxFieldCount {
+			return nil, ErrTooManyHeaders
+		}
 		fs := strings.SplitN(line, ":", 2)
 		if len(fs) != 2 {
 			return nil, fmt.Errorf("Invalid header format")
@@ -74,7 +127,7 @@ type RequestReader struct {
 
 func NewRequestReader(r io.Reader) *RequestReader {
 	rr := &RequestReader{
-		baseReader{toBufioReader(r), make(chan error)},
+		baseReader{toBufioReader(r), make(chan error), headerLimits},
 		&Request{},
 		make(chan *Request),
 	}
@@ -96,9 +149,9 @@ func (r *RequestReader) Start() {
 }
 
 func (r *RequestReader) readRequestLine() error {
-	rl, err := r.readLine()
+	rl, err := r.readLine(r.limits.MaxLineLength, ErrLineTooLong)
 	if err != nil {
-		return fmt.Errorf("Failed to read request line: %v", err)
+		return fmt.Errorf("Failed to read request line: %w", err)
 	}
 	fields := strings.Split(rl, " ")
 	if len(fields) != 3 {
@@ -131,7 +184,7 @@ type ResponseReader struct {
 
 func NewResponseReader(r io.Reader) *ResponseReader {
 	rr := &ResponseReader{
-		baseReader{toBufioReader(r), make(chan error)},
+		baseReader{toBufioReader(r), make(chan error), headerLimits},
 		&Response{},
 		make(chan *Response),
 	}
@@ -152,31 +205,48 @@ func (r *ResponseReader) Start() {
 	}()
 }
 
+// HTTP-version = "HTTP/" DIGIT "." DIGIT
+func isValidHTTPVersion(v string) bool {
+	return len(v) == 8 && strings.HasPrefix(v, "HTTP/") &&
+		isDigit(v[5]) && v[6] == '.' && isDigit(v[7])
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// status-code = 3DIGIT
 func parseStatusCode(ss string) (int, error) {
-	status, err := strconv.Atoi(ss)
+	if len(ss) != 3 || !isDigit(ss[0]) || !isDigit(ss[1]) || !isDigit(ss[2]) {
+		return 0, fmt.Errorf("Invalid status code: %s", ss)
+	}
+	status, _ := strconv.Atoi(ss)
 	first := status / 100
-	if err != nil || (first < 1 || first > 5) {
+	if first < 1 || first > 5 {
 		return 0, fmt.Errorf("Invalid status code: %s", ss)
 	}
 	return status, nil
 }
 
+// status-line = HTTP-version SP status-code SP [ reason-phrase ]
+// The reason phrase is kept byte for byte. A missing SP after the status
+// code is tolerated since some servers omit it along with the phrase.
 func (r *ResponseReader) readStatusLine() error {
-	sl, err := r.readLine()
+	sl, err := r.readLine(r.limits.MaxLineLength, ErrLineTooLong)
 	if err != nil {
-		return fmt.Errorf("Failed to read status line: %v", err)
+		return fmt.Errorf("Failed to read status line: %w", err)
 	}
-	// TODO: Not an ideal
-	fields := strings.Split(sl, " ")
-	if len(fields) < 3 {
+	version, rest, ok := strings.Cut(sl, " ")
+	if !ok || !isValidHTTPVersion(version) {
 		return fmt.Errorf("Invalid status line: %s", sl)
 	}
-	r.res.Version = fields[0]
-	r.res.Status, err = parseStatusCode(fields[1])
+	code, phrase, _ := strings.Cut(rest, " ")
+	r.res.Version = version
+	r.res.Status, err = parseStatusCode(code)
 	if err != nil {
 		return err
 	}
-	r.res.Phrase = strings.Join(fields[2:], " ")
+	r.res.Phrase = phrase
 	return nil
 }
 
@@ -198,6 +268,8 @@ type BodyReader interface {
 	Cancel()
 	BodyReceived() <-chan []byte
 	ErrorOccurred() <-chan error
+	// SetLogger must be called before Start.
+	SetLogger(*Logger)
 }
 
 type baseBodyReader struct {
@@ -206,10 +278,15 @@ type baseBodyReader struct {
 	bodyCh chan []byte
 	errCh  chan error
 	done   chan struct{}
+	log    *Logger
+}
+
+func (r *baseBodyReader) SetLogger(l *Logger) {
+	r.log = l
 }
 
 func (r *baseBodyReader) Cancel() {
-	log.Printf("I body reader canceled")
+	r.log.Debugf("body reader canceled")
 	close(r.done)
 }
 
@@ -225,7 +302,7 @@ func (r *baseBodyReader) sendError(err error) {
 	// TODO: of course this is wrong.
 	select {
 	case <-r.done:
-		log.Printf("W body reader closed while sending error")
+		r.log.Warnf("body reader closed while sending error")
 	case r.errCh <- err:
 	}
 }
@@ -248,7 +325,7 @@ func (r *baseBodyReader) readAndSend(sz int) {
 			select {
 			case r.bodyCh <- tmp:
 			case <-r.done:
-				log.Printf("W body reader closed while sending body")
+				r.log.Warnf("body reader closed while sending body")
 				return
 			}
 			total += n
@@ -275,7 +352,8 @@ func NewFixedLengthBodyReader(r io.Reader, cl int) *FixedLengthBodyReader {
 			make([]byte, 4096),
 			make(chan []byte),
 			make(chan error),
-			make(chan struct{})},
+			make(chan struct{}),
+			logger},
 		cl,
 	}
 }
@@ -284,7 +362,7 @@ func (r *FixedLengthBodyReader) Start() {
 	go func() {
 		defer func() {
 			close(r.bodyCh)
-			log.Printf("I FixedLengthBodyReader done")
+			r.log.Debugf("FixedLengthBodyReader done")
 		}()
 		r.readAndSend(r.contentLength)
 	}()
@@ -303,6 +381,7 @@ func NewChunkedBodyReader(r io.Reader) *ChunkedBodyReader {
 			make(chan []byte),
 			make(chan error),
 			make(chan struct{}),
+			logger,
 		},
 	}
 }
@@ -311,7 +390,7 @@ func (r *ChunkedBodyReader) Start() {
 	go func() {
 		defer func() {
 			close(r.bodyCh)
-			log.Printf("I ChunkedBodyReader done")
+			r.log.Debugf("ChunkedBodyReader done")
 		}()
 
 		for {
@@ -365,6 +444,34 @@ func (r *ChunkedBodyReader) readAndSendChunkLength() (int, error) {
 	return l, nil
 }
 
+// StreamBodyReader reads until EOF. Used for tunnels.
+type StreamBodyReader struct {
+	baseBodyReader
+}
+
+func NewStreamBodyReader(r io.Reader) *StreamBodyReader {
+	return &StreamBodyReader{
+		baseBodyReader{
+			toBufioReader(r),
+			make([]byte, 4096),
+			make(chan []byte),
+			make(chan error),
+			make(chan struct{}),
+			logger,
+		},
+	}
+}
+
+func (r *StreamBodyReader) Start() {
+	go func() {
+		defer func() {
+			close(r.bodyCh)
+			r.log.Debugf("StreamBodyReader done")
+		}()
+		r.readAndSend(math.MaxInt)
+	}()
+}
+
 // ClientConnectionWatcher is used when a request has no body.
 // It checks whether a client is alive.
 type ClientConnectionWatcher struct {
@@ -379,6 +486,7 @@ func NewClientConnectionWatcher(r io.Reader) *ClientConnectionWatcher {
 			make(chan []byte),
 			make(chan error),
 			make(chan struct{}),
+			logger,
 		},
 	}
 }
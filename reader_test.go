@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
@@ -104,3 +105,87 @@ func TestChunkedBodyReader(t *testing.T) {
 	}
 	ExpectEqual(t, "6\r\nFooBar\r\nd\r\nThisIsChunked\r\n0\r\n\r\n", string(body))
 }
+
+func TestRequestReaderLimits(t *testing.T) {
+	saved := headerLimits
+	defer func() { headerLimits = saved }()
+	headerLimits = HeaderLimits{
+		MaxLineLength:  20,
+		MaxFieldLength: 16,
+		MaxHeaderBytes: 30,
+		MaxFieldCount:  3,
+	}
+
+	cases := []struct {
+		in     string
+		expect error
+	}{
+		{"GET /aaaaaaaaaaaaaaaaaaaa HTTP/1.1\r\n\r\n", ErrLineTooLong},
+		{"GET / HTTP/1.1\r\nX-Long: aaaaaaaaaaaa\r\n\r\n", ErrHeaderFieldTooLong},
+		{"GET / HTTP/1.1\r\nA: 1234567890\r\nB: 1234567890\r\nC: 1234567890\r\n\r\n", ErrHeaderTooLarge},
+		{"GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n", ErrTooManyHeaders},
+	}
+	for _, c := range cases {
+		_, err := readRequestSync(strings.NewReader(c.in))
+		if !errors.Is(err, c.expect) {
+			t.Errorf("%q: got %v, want %v", c.in, err, c.expect)
+		}
+	}
+
+	_, err := readRequestSync(strings.NewReader("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\n\r\n"))
+	if err != nil {
+		t.Errorf("error: %v", err)
+	}
+}
+
+func TestResponseReaderLimits(t *testing.T) {
+	saved := headerLimits
+	defer func() { headerLimits = saved }()
+	headerLimits.MaxFieldCount = 1
+
+	_, err := readResponseSync(strings.NewReader("HTTP/1.1 200 OK\r\nA: 1\r\nB: 2\r\n\r\n"))
+	if !isHeaderLimitError(err) {
+		t.Errorf("got %v, want a header limit error", err)
+	}
+}
+
+func TestResponseReaderStatusLine(t *testing.T) {
+	cases := []struct {
+		line   string
+		status int
+		phrase string
+	}{
+		{"HTTP/1.1 200 OK", 200, "OK"},
+		{"HTTP/1.1 200 ", 200, ""},
+		{"HTTP/1.1 200", 200, ""},
+		{"HTTP/1.0 404 Not  Found ", 404, "Not  Found "},
+		{"HTTP/1.1 599 \tweird\t", 599, "\tweird\t"},
+	}
+	for _, c := range cases {
+		res, err := readResponseSync(strings.NewReader(c.line + "\r\n\r\n"))
+		if err != nil {
+			t.Errorf("%q: error: %v", c.line, err)
+			continue
+		}
+		if res.Status != c.status {
+			t.Errorf("%q: got status %d, want %d", c.line, res.Status, c.status)
+		}
+		ExpectEqual(t, c.phrase, res.Phrase)
+	}
+
+	invalid := []string{
+		"HTTP/1.1  200 OK",
+		"HTTP/1.1 20 OK",
+		"HTTP/1.1 2000 OK",
+		"HTTP/1.1 +20 OK",
+		"HTTP/1.1 600 OK",
+		"HTTP/11 200 OK",
+		"http/1.1 200 OK",
+		"HTTP/1.1",
+	}
+	for _, line := range invalid {
+		if _, err := readResponseSync(strings.NewReader(line + "\r\n\r\n")); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
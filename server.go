@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Server accepts connections and keeps track of running workers so that
+// they can be drained on shutdown.
+type Server struct {
+	mu      sync.Mutex
+	workers map[*Worker]struct{}
+	wg      sync.WaitGroup
+	limiter *connLimiter
+}
+
+func NewServer() *Server {
+	return &Server{
+		workers: make(map[*Worker]struct{}),
+		limiter: newConnLimiter(loadSettings().ConnLimits),
+	}
+}
+
+// Serve accepts connections until |ln| is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	var delay time.Duration // before retrying a failed Accept
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			// Like net/http, back off so that errors such as running out
+			// of file descriptors don't spin.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			logger.Errorf("accept error: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		metrics.ConnsAccepted.inc()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	client := clientIP(conn.RemoteAddr())
+	start := time.Now()
+	if err := s.limiter.acquire(client); err != nil {
+		refuseConn(conn, err, s.limiter.currentLimits().RetryAfter)
+		accessLog.Write(&AccessRecord{
+			Time:        start,
+			Client:      conn.RemoteAddr().String(),
+			Status:      503,
+			Termination: TermConnLimit,
+			Total:       time.Since(start),
+		})
+		return
+	}
+	defer s.limiter.release(client)
+	metrics.ConnsActive.inc()
+	defer metrics.ConnsActive.add(-1)
+
+	worker := NewWorker()
+	worker.log.Debugf("accepted connection from %v", conn.RemoteAddr())
+	s.mu.Lock()
+	s.workers[worker] = struct{}{}
+	s.mu.Unlock()
+
+	worker.Start(conn)
+
+	s.mu.Lock()
+	delete(s.workers, worker)
+	s.mu.Unlock()
+}
+
+// cancelWorkers cancels workers which are still waiting for a request,
+// or all of them if |idleOnly| is false. Returns the number canceled.
+func (s *Server) cancelWorkers(idleOnly bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for w := range s.workers {
+		if idleOnly && !w.isIdle() {
+			continue
+		}
+		w.Cancel()
+		n++
+	}
+	return n
+}
+
+// Workers describes the running workers, ordered by ID.
+func (s *Server) Workers() []WorkerInfo {
+	s.mu.Lock()
+	infos := make([]WorkerInfo, 0, len(s.workers))
+	for w := range s.workers {
+		infos = append(infos, w.Info())
+	}
+	s.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CancelWorker cancels the worker with |id|. Returns false if there is no
+// such worker.
+func (s *Server) CancelWorker(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.workers {
+		if w.connID == id {
+			w.Cancel()
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) wait(timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Drain must be called after Serve returned. Idle connections are closed
+// right away, and active workers get |grace| to finish before they are
+// canceled. Returns true if every worker finished within the grace period.
+func (s *Server) Drain(grace time.Duration) bool {
+	if n := s.cancelWorkers(true); n > 0 {
+		logger.Infof("closed %d idle connections", n)
+	}
+	if s.wait(grace) {
+		logger.Infof("all workers finished")
+		return true
+	}
+	n := s.cancelWorkers(false)
+	logger.Warnf("canceled %d workers after grace period", n)
+	if !s.wait(forceCancelWait) {
+		logger.Errorf("workers did not finish after cancel")
+	}
+	return false
+}
+
+// How long Drain waits for canceled workers to wind down.
+var forceCancelWait = 5 * time.Second
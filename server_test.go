@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T) (*Server, net.Listener, <-chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer()
+	served := make(chan struct{})
+	go func() {
+		srv.Serve(ln)
+		close(served)
+	}()
+	return srv, ln, served
+}
+
+func waitForWorkers(srv *Server, n int) {
+	for i := 0; i < 100; i++ {
+		srv.mu.Lock()
+		m := len(srv.workers)
+		srv.mu.Unlock()
+		if m == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failingListener fails |n| Accept calls with EMFILE, then is closed.
+type failingListener struct {
+	net.Listener
+	n     int
+	calls []time.Time
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.calls = append(l.calls, time.Now())
+	if len(l.calls) > l.n {
+		return nil, net.ErrClosed
+	}
+	return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+}
+
+func TestServerAcceptBackoff(t *testing.T) {
+	b, restore := captureLog(LevelError)
+	defer restore()
+	l := &failingListener{n: 4}
+	NewServer().Serve(l)
+	for i, want := range []time.Duration{5, 10, 20, 40} {
+		want *= time.Millisecond
+		if gap := l.calls[i+1].Sub(l.calls[i]); gap < want {
+			t.Errorf("retry %d after %v, want %v", i+1, gap, want)
+		}
+		ExpectEqual(t, "true", fmt.Sprint(strings.Contains(b.String(), "retrying in "+want.String()+"\n")))
+	}
+}
+
+func TestServerDrainClosesIdleConnections(t *testing.T) {
+	srv, ln, served := startTestServer(t)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitForWorkers(srv, 1)
+
+	ln.Close()
+	<-served
+	if !srv.Drain(time.Second) {
+		t.Errorf("drain was not clean")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestServerDrainCancelsActiveWorkers(t *testing.T) {
+	dialed := make(chan struct{})
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		defer close(dialed)
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, c) // never answers
+		return s, nil
+	}
+	srv, ln, served := startTestServer(t)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	<-dialed
+
+	ln.Close()
+	<-served
+	if srv.Drain(50 * time.Millisecond) {
+		t.Errorf("drain should not be clean")
+	}
+	waitForWorkers(srv, 0)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Ranges blocked by "-block-range private". Covers loopback, link-local
+// (including the 169.254.169.254 metadata endpoint), private and other
+// special purpose networks.
+var DefaultBlockedRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+var ErrBlockedDestination = errors.New("Destination address is blocked")
+
+// DestinationGuard resolves a destination before connecting and refuses
+// to connect if any of its addresses is in a blocked range, so that host
+// names resolving to internal addresses can't bypass host based ACLs.
+type DestinationGuard struct {
+	Blocked []*net.IPNet
+	// Host patterns, as in ACLRule.Hosts, which may resolve to blocked
+	// addresses.
+	Exempt []string
+}
+
+// Used by workers unless a configuration file sets other ranges.
+var destinationGuard = &DestinationGuard{}
+
+// Used to resolve host names. Can be mocked.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+func (g *DestinationGuard) isBlocked(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range g.Blocked {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *DestinationGuard) isExempt(host string) bool {
+	for _, p := range g.Exempt {
+		if matchHostPattern(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the addresses to connect to for |host|.
+func (g *DestinationGuard) resolve(host string, timeout time.Duration) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	addrs, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+// Dial connects to |addr| after checking every address it resolves to.
+// The checked addresses are dialed directly so that a second lookup can't
+// return something else.
+func (g *DestinationGuard) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Blocked) == 0 || g.isExempt(host) {
+		return serverDialer(addr, timeout)
+	}
+
+	start := time.Now()
+	ips, err := g.resolve(host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if g.isBlocked(ip) {
+			return nil, fmt.Errorf("%s resolves to %v: %w", host, ip, ErrBlockedDestination)
+		}
+	}
+
+	for _, ip := range ips {
+		left := time.Duration(0)
+		if timeout > 0 {
+			if left = timeout - time.Since(start); left <= 0 {
+				break
+			}
+		}
+		var conn net.Conn
+		conn, err = serverDialer(net.JoinHostPort(ip.String(), port), left)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("Dial to %s: %w", addr, os.ErrDeadlineExceeded)
+	}
+	return nil, err
+}
+
+// blockRangeFlag adds a range to g, or the default ranges for "private".
+type blockRangeFlag struct {
+	g *DestinationGuard
+}
+
+func (blockRangeFlag) String() string {
+	return ""
+}
+
+func (f blockRangeFlag) Set(s string) error {
+	ranges := []string{s}
+	if s == "private" {
+		ranges = DefaultBlockedRanges
+	}
+	for _, r := range ranges {
+		n, err := parseCIDR(r)
+		if err != nil {
+			return err
+		}
+		f.g.Blocked = append(f.g.Blocked, n)
+	}
+	return nil
+}
+
+// exemptFlag allows a host pattern to resolve to blocked ranges.
+type exemptFlag struct {
+	g *DestinationGuard
+}
+
+func (exemptFlag) String() string {
+	return ""
+}
+
+func (f exemptFlag) Set(s string) error {
+	f.g.Exempt = append(f.g.Exempt, s)
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestGuard(t *testing.T, ranges ...string) *DestinationGuard {
+	g := &DestinationGuard{}
+	for _, r := range ranges {
+		n, err := parseCIDR(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.Blocked = append(g.Blocked, n)
+	}
+	return g
+}
+
+func mockLookup(hosts map[string][]string) func() {
+	saved := lookupIPAddr
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		var addrs []net.IPAddr
+		for _, s := range hosts[host] {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(s)})
+		}
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return addrs, nil
+	}
+	return func() { lookupIPAddr = saved }
+}
+
+func TestDestinationGuardBlocks(t *testing.T) {
+	defer mockLookup(map[string][]string{
+		"evil.example.com":  {"93.184.216.34", "169.254.169.254"},
+		"local.example.com": {"::ffff:127.0.0.1"},
+	})()
+	g := newTestGuard(t, DefaultBlockedRanges...)
+
+	for _, addr := range []string{
+		"evil.example.com:80",
+		"local.example.com:80",
+		"127.0.0.1:80",
+		"[::1]:443",
+		"10.1.2.3:8080",
+	} {
+		_, err := g.Dial(addr, time.Second)
+		if !errors.Is(err, ErrBlockedDestination) {
+			t.Errorf("%s: got %v, want blocked", addr, err)
+		}
+	}
+}
+
+func TestDestinationGuardAllows(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	saved := serverDialer
+	defer func() { serverDialer = saved }()
+	serverDialer = dialTCP
+	defer mockLookup(map[string][]string{
+		"app.example.com": {"127.0.0.1"},
+	})()
+
+	g := newTestGuard(t, "10.0.0.0/8")
+	conn, err := g.Dial("app.example.com:"+port, time.Second)
+	if err != nil {
+		t.Fatalf("unblocked destination failed: %v", err)
+	}
+	conn.Close()
+
+	g = newTestGuard(t, "127.0.0.0/8")
+	g.Exempt = []string{"localhost"}
+	conn, err = g.Dial("localhost:"+port, time.Second)
+	if err != nil {
+		t.Fatalf("exempt destination failed: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Timeouts for each phase of a worker. Zero disables the timeout.
+type Timeouts struct {
+	Dial         time.Duration // connecting to the server
+	ClientHeader time.Duration // reading request line and headers
+	FirstByte    time.Duration // from sending request and body to receiving response headers
+	BodyIdle     time.Duration // max gap between body reads or writes
+	Total        time.Duration // lifetime of a worker
+}
+
+var DefaultTimeouts = Timeouts{
+	Dial:         10 * time.Second,
+	ClientHeader: 30 * time.Second,
+	FirstByte:    60 * time.Second,
+	BodyIdle:     60 * time.Second,
+	Total:        0,
+}
+
+// Used by workers created from now on. Can be overridden by flags.
+var timeouts = DefaultTimeouts
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func earlier(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// timeoutConn sets a deadline before every Read and Write. Reads are
+// bounded either by a fixed deadline (while reading headers) or by an
+// idle timeout renewed on every Read (while reading a body). Writes are
+// bounded by an idle timeout. No deadline ever goes beyond |limit|.
+type timeoutConn struct {
+	net.Conn
+	mu           sync.Mutex
+	readDeadline time.Time
+	readIdle     time.Duration
+	writeIdle    time.Duration
+	limit        time.Time
+}
+
+func newTimeoutConn(conn net.Conn, limit time.Time) *timeoutConn {
+	return &timeoutConn{Conn: conn, limit: limit}
+}
+
+func (c *timeoutConn) setReadDeadline(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.readIdle = 0
+}
+
+// armReadDeadline is setReadDeadline, also applied to a Read in progress.
+func (c *timeoutConn) armReadDeadline(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.readIdle = 0
+	c.Conn.SetReadDeadline(c.nextReadDeadline())
+}
+
+func (c *timeoutConn) setReadIdle(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = time.Time{}
+	c.readIdle = d
+}
+
+func (c *timeoutConn) setWriteIdle(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeIdle = d
+}
+
+// nextReadDeadline is called with |mu| held.
+func (c *timeoutConn) nextReadDeadline() time.Time {
+	t := c.readDeadline
+	if c.readIdle > 0 {
+		t = time.Now().Add(c.readIdle)
+	}
+	return earlier(t, c.limit)
+}
+
+func (c *timeoutConn) nextWriteDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var t time.Time
+	if c.writeIdle > 0 {
+		t = time.Now().Add(c.writeIdle)
+	}
+	return earlier(t, c.limit)
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	// Holding |mu| keeps a deadline armed meanwhile from being overwritten.
+	c.mu.Lock()
+	c.Conn.SetReadDeadline(c.nextReadDeadline())
+	c.mu.Unlock()
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(c.nextWriteDeadline())
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runWorkerOnPipe starts a worker on one end of a pipe and returns the
+// other end as the client.
+func runWorkerOnPipe(t Timeouts) (net.Conn, <-chan struct{}) {
+	saved := timeouts
+	timeouts = t
+	w := NewWorker()
+	timeouts = saved
+
+	client, conn := net.Pipe()
+	finished := make(chan struct{})
+	go func() {
+		w.Start(conn)
+		close(finished)
+	}()
+	return client, finished
+}
+
+func readStatusLineWithin(t *testing.T, c net.Conn, d time.Duration) string {
+	c.SetReadDeadline(time.Now().Add(d))
+	b, _ := io.ReadAll(c)
+	line, _, _ := strings.Cut(string(b), "\r\n")
+	return line
+}
+
+func TestWorkerClientHeaderTimeout(t *testing.T) {
+	client, finished := runWorkerOnPipe(Timeouts{ClientHeader: 50 * time.Millisecond})
+	client.Write([]byte("GET / HTTP/1.1\r\n"))
+
+	ExpectEqual(t, "HTTP/1.1 408 Request Timeout", readStatusLineWithin(t, client, time.Second))
+	<-finished
+}
+
+func TestWorkerFirstByteTimeout(t *testing.T) {
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, c) // never answers
+		return s, nil
+	}
+	client, finished := runWorkerOnPipe(Timeouts{FirstByte: 50 * time.Millisecond})
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	ExpectEqual(t, "HTTP/1.1 504 Gateway Timeout", readStatusLineWithin(t, client, time.Second))
+	<-finished
+}
+
+func TestWorkerFirstByteTimeoutAfterUpload(t *testing.T) {
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		s, c := net.Pipe()
+		go func() {
+			req, err := http.ReadRequest(bufio.NewReader(c))
+			if err != nil {
+				return
+			}
+			if body, _ := io.ReadAll(req.Body); string(body) == "slow" {
+				io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+			}
+			io.Copy(io.Discard, c) // never answers otherwise
+		}()
+		return s, nil
+	}
+	// Uploading longer than the timeout doesn't count against it.
+	for _, body := range []string{"slow", "mute"} {
+		client, finished := runWorkerOnPipe(Timeouts{FirstByte: 50 * time.Millisecond})
+		client.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\n"))
+		for i := range body {
+			time.Sleep(30 * time.Millisecond)
+			client.Write([]byte{body[i]})
+		}
+		want := map[string]string{"slow": "HTTP/1.1 200 OK", "mute": "HTTP/1.1 504 Gateway Timeout"}[body]
+		ExpectEqual(t, want, readStatusLineWithin(t, client, time.Second))
+		client.Close()
+		<-finished
+	}
+}
+
+func TestWorkerTotalTimeout(t *testing.T) {
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, c)
+		// never sends the rest of the body
+		go io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nFoo")
+		return s, nil
+	}
+	client, finished := runWorkerOnPipe(Timeouts{Total: 100 * time.Millisecond})
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	ExpectEqual(t, "HTTP/1.1 200 OK", readStatusLineWithin(t, client, time.Second))
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Errorf("worker did not finish")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	var got time.Duration
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		got = timeout
+		return nil, &net.OpError{Op: "dial", Err: timeoutError{}}
+	}
+	client, finished := runWorkerOnPipe(Timeouts{Dial: 3 * time.Second})
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	ExpectEqual(t, "HTTP/1.1 504 Gateway Timeout", readStatusLineWithin(t, client, time.Second))
+	<-finished
+	if got != 3*time.Second {
+		t.Errorf("got dial timeout %v, want 3s", got)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
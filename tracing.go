@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TraceContext is a parsed W3C traceparent header.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte // the parent span, zero if the trace starts here
+	Flags   byte
+}
+
+const traceFlagSampled = 0x01
+
+// parseTraceparent parses "00-<trace-id>-<parent-id>-<flags>". Later
+// versions are accepted as long as they start with the same fields.
+func parseTraceparent(s string) (TraceContext, bool) {
+	var c TraceContext
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return c, false
+	}
+	version, ok := parseHexBytes(s[:2], 1)
+	if !ok || version[0] == 0xff || (version[0] == 0 && len(s) != 55) ||
+		(len(s) > 55 && s[55] != '-') {
+		return c, false
+	}
+	traceID, ok1 := parseHexBytes(s[3:35], 16)
+	spanID, ok2 := parseHexBytes(s[36:52], 8)
+	flags, ok3 := parseHexBytes(s[53:55], 1)
+	if !ok1 || !ok2 || !ok3 {
+		return c, false
+	}
+	copy(c.TraceID[:], traceID)
+	copy(c.SpanID[:], spanID)
+	c.Flags = flags[0]
+	if c.TraceID == [16]byte{} || c.SpanID == [8]byte{} {
+		return c, false
+	}
+	return c, true
+}
+
+// parseHexBytes decodes |n| bytes of lowercase hex.
+func parseHexBytes(s string, n int) ([]byte, bool) {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return nil, false
+		}
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil && len(b) == n
+}
+
+// traceparent formats the header for a child of |spanID|.
+func (c TraceContext) traceparent(spanID [8]byte) string {
+	return fmt.Sprintf("00-%x-%x-%02x", c.TraceID, spanID, c.Flags)
+}
+
+func newSpanID() [8]byte {
+	var id [8]byte
+	for id == [8]byte{} {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newTraceID() [16]byte {
+	var id [16]byte
+	for id == [16]byte{} {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// requestTrace holds the IDs of the spans of one proxied request.
+type requestTrace struct {
+	TraceContext         // as received, or a new sampled trace
+	server       [8]byte // span of the whole request
+	forward      [8]byte // span of the upstream exchange, the parent upstream
+}
+
+// newRequestTrace continues the trace in |h|, or starts one if it has
+// no valid traceparent, and sets the headers to send upstream.
+// tracestate is passed on unchanged.
+func newRequestTrace(h HTTPHeader) *requestTrace {
+	t := &requestTrace{server: newSpanID(), forward: newSpanID()}
+	c, ok := parseTraceparent(h["traceparent"])
+	if ok {
+		t.TraceContext = c
+	} else {
+		t.TraceID = newTraceID()
+		t.Flags = traceFlagSampled
+		delete(h, "tracestate")
+	}
+	h["traceparent"] = t.traceparent(t.forward)
+	return t
+}
+
+func (t *requestTrace) sampled() bool {
+	return t.Flags&traceFlagSampled != 0
+}
+
+type SpanKind int
+
+// Values of the OTLP enum.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span is a finished span.
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte // zero for a root span
+	Name       string
+	Kind       SpanKind
+	Start      time.Time
+	End        time.Time
+	Attributes []SpanAttribute
+	Error      string // sets the status to error if not empty
+}
+
+// SpanAttribute has a string or int64 value.
+type SpanAttribute struct {
+	Key   string
+	Value any
+}
+
+// Terminations which mark the request span as failed.
+var failedTerminations = map[string]bool{
+	TermDialError:       true,
+	TermDialTimeout:     true,
+	TermUpstreamError:   true,
+	TermUpstreamTimeout: true,
+}
+
+// SpanExporter sends spans in batches to an OTLP/HTTP collector, encoded
+// in JSON.
+type SpanExporter struct {
+	endpoint string // e.g. http://localhost:4318/v1/traces
+	service  string
+	client   *http.Client
+	spans    chan *Span
+	done     chan struct{}
+	finished chan struct{}
+	once     sync.Once
+}
+
+// Spans are sent when this many are queued, or after spanFlushInterval.
+const spanBatchSize = 512
+
+var spanFlushInterval = 5 * time.Second
+
+// Set by -trace-endpoint, nil if tracing is disabled.
+var spanExporter *SpanExporter
+
+func NewSpanExporter(endpoint, service string) *SpanExporter {
+	e := &SpanExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *Span, 4*spanBatchSize),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export queues |spans|. Spans are dropped if the queue is full, so a
+// slow collector never blocks requests.
+func (e *SpanExporter) Export(spans ...*Span) {
+	for _, s := range spans {
+		select {
+		case <-e.done:
+			return
+		case e.spans <- s:
+		default:
+			logger.Warnf("tracing: queue full, dropping span %s", s.Name)
+		}
+	}
+}
+
+// Close sends the queued spans and stops the exporter.
+func (e *SpanExporter) Close() {
+	e.once.Do(func() { close(e.done) })
+	<-e.finished
+}
+
+func (e *SpanExporter) run() {
+	defer close(e.finished)
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.post(batch); err != nil {
+			logger.Warnf("tracing: dropped %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-e.spans:
+			if batch = append(batch, s); len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.done:
+			for {
+				select {
+				case s := <-e.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *SpanExporter) post(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector responded %s", res.Status)
+	}
+	return nil
+}
+
+// OTLP JSON encoding of ExportTraceServiceRequest. IDs are hex and 64-bit
+// integers are strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    string  `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+func otlpAttributes(attrs []SpanAttribute) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		switch x := a.Value.(type) {
+		case int64:
+			v.IntValue = strconv.FormatInt(x, 10)
+		case int:
+			v.IntValue = strconv.Itoa(x)
+		default:
+			s := fmt.Sprint(x)
+			v.StringValue = &s
+		}
+		out = append(out, otlpAttribute{a.Key, v})
+	}
+	return out
+}
+
+func (e *SpanExporter) request(spans []*Span) *otlpRequest {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		out[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.ParentID != [8]byte{} {
+			out[i].ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		if s.Error != "" {
+			out[i].Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(
+			[]SpanAttribute{{"service.name", e.service}})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "proxy"}, Spans: out}},
+	}}}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	c, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatal("valid traceparent rejected")
+	}
+	ExpectEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736 00f067aa0ba902b7 1",
+		fmt.Sprintf("%x %x %d", c.TraceID, c.SpanID, c.Flags))
+	ExpectEqual(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000001-01",
+		c.traceparent([8]byte{7: 1}))
+
+	if _, ok := parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); !ok {
+		t.Errorf("later version rejected")
+	}
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0g",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+	} {
+		if _, ok := parseTraceparent(s); ok {
+			t.Errorf("%q: expected invalid", s)
+		}
+	}
+}
+
+// startStubCollector records the spans posted to it.
+func startStubCollector(t *testing.T) (*httptest.Server, func() []otlpSpan) {
+	var mu sync.Mutex
+	var spans []otlpSpan
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("collector: %v", err)
+		}
+		ExpectEqual(t, "/v1/traces", r.URL.Path)
+		ExpectEqual(t, "proxy-test", *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+		mu.Lock()
+		spans = append(spans, req.ResourceSpans[0].ScopeSpans[0].Spans...)
+		mu.Unlock()
+	}))
+	return srv, func() []otlpSpan {
+		mu.Lock()
+		defer mu.Unlock()
+		return spans
+	}
+}
+
+// runTracedRequest proxies |header| and returns the traceparent and
+// tracestate sent upstream with the exported spans.
+func runTracedRequest(t *testing.T, header string) (string, string, []otlpSpan) {
+	collector, collected := startStubCollector(t)
+	defer collector.Close()
+	spanExporter = NewSpanExporter(collector.URL+"/v1/traces", "proxy-test")
+	defer func() { spanExporter = nil }()
+
+	upstream := make(chan HTTPHeader, 1)
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		s, c := net.Pipe()
+		go func() {
+			r := bufio.NewReader(c)
+			r.ReadString('\n')
+			h := HTTPHeader{}
+			for {
+				line, _ := r.ReadString('\n')
+				line = strings.TrimSpace(line)
+				if line == "" {
+					break
+				}
+				k, v, _ := strings.Cut(line, ":")
+				h[strings.ToLower(k)] = strings.TrimSpace(v)
+			}
+			upstream <- h
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nabc")
+			io.Copy(io.Discard, c)
+		}()
+		return s, nil
+	}
+	client, finished := runWorkerOnPipe(Timeouts{})
+	client.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n" + header + "\r\n"))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(client)
+	for line := ""; line != "\r\n"; {
+		var err error
+		if line, err = r.ReadString('\n'); err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+	}
+	io.ReadFull(r, make([]byte, 3))
+	client.Close()
+	<-finished
+	spanExporter.Close()
+
+	h := <-upstream
+	return h["traceparent"], h["tracestate"], collected()
+}
+
+func TestWorkerTracing(t *testing.T) {
+	traceparent, tracestate, spans := runTracedRequest(t,
+		"Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n"+
+			"Tracestate: vendor=abc\r\n")
+	ExpectEqual(t, "vendor=abc", tracestate)
+	c, ok := parseTraceparent(traceparent)
+	if !ok {
+		t.Fatalf("invalid traceparent sent upstream: %q", traceparent)
+	}
+	ExpectEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", fmt.Sprintf("%x", c.TraceID))
+
+	var names []string
+	byName := map[string]otlpSpan{}
+	for _, s := range spans {
+		names = append(names, s.Name)
+		byName[s.Name] = s
+		ExpectEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", s.TraceID)
+	}
+	ExpectEqual(t, "GET dial forward request stream response", strings.Join(names, " "))
+	server := byName["GET"]
+	ExpectEqual(t, "00f067aa0ba902b7", server.ParentSpanID)
+	ExpectEqual(t, "2", fmt.Sprint(server.Kind))
+	for _, name := range []string{"dial", "forward request", "stream response"} {
+		ExpectEqual(t, server.SpanID, byName[name].ParentSpanID)
+	}
+	// The upstream server continues from the forwarding span.
+	ExpectEqual(t, fmt.Sprintf("%x", c.SpanID), byName["forward request"].SpanID)
+}
+
+func TestWorkerTracingStartsTrace(t *testing.T) {
+	traceparent, tracestate, spans := runTracedRequest(t,
+		"Traceparent: invalid\r\nTracestate: vendor=abc\r\n")
+	ExpectEqual(t, "", tracestate)
+	c, ok := parseTraceparent(traceparent)
+	if !ok {
+		t.Fatalf("invalid traceparent sent upstream: %q", traceparent)
+	}
+	ExpectEqual(t, "1", fmt.Sprint(c.Flags))
+	ExpectEqual(t, "4", fmt.Sprint(len(spans)))
+	ExpectEqual(t, "", spans[0].ParentSpanID)
+	ExpectEqual(t, fmt.Sprintf("%x", c.TraceID), spans[0].TraceID)
+
+	// Unsampled traces are propagated but not exported.
+	traceparent, _, spans = runTracedRequest(t,
+		"Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00\r\n")
+	ExpectEqual(t, "00", traceparent[len(traceparent)-2:])
+	ExpectEqual(t, "0", fmt.Sprint(len(spans)))
+}
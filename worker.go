@@ -2,25 +2,34 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var _ = fmt.Println
 
 func appendPortIfNeeded(h string) string {
-	// TODO: support https
+	return appendDefaultPort(h, "80")
+}
+
+func appendDefaultPort(h, port string) string {
 	pos := strings.LastIndex(h, ":")
 	if pos == -1 {
-		return h + ":80"
+		return h + ":" + port
 	}
 	p, err := strconv.Atoi(h[pos+1:])
 	if err != nil || p == 0 {
-		return h + ":80"
+		return h + ":" + port
 	}
 	return h
 }
@@ -55,30 +64,38 @@ func createBodyReader(r io.Reader, h HTTPHeader) BodyReader {
 	return nil
 }
 
-type DialerFunc func(string) (net.Conn, error)
+type DialerFunc func(string, time.Duration) (net.Conn, error)
 
-// Used to connect server. Can be mocked.
-var serverDialer = func(addr string) (net.Conn, error) {
-	return net.Dial("tcp", addr)
+// Used to connect server after DestinationGuard checked the address. Can
+// be mocked.
+var serverDialer DialerFunc = dialTCP
+
+func dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
 }
 
 type bodyTransfer struct {
-	r      BodyReader
-	w      io.Writer
-	done   <-chan struct{}
-	finish chan struct{}
-	errCh  chan error
+	r        BodyReader
+	w        io.Writer
+	done     <-chan struct{}
+	finish   chan struct{}
+	errCh    chan error
+	log      *Logger
+	err      error // read or write error other than EOF, set before finish
+	complete bool  // the body ended, set before finish
 }
 
 func newBodyTransfer(
-	r BodyReader, w io.Writer, done <-chan struct{}) *bodyTransfer {
-	t := &bodyTransfer{r, w, done, make(chan struct{}), make(chan error)}
+	r BodyReader, w io.Writer, done <-chan struct{}, l *Logger) *bodyTransfer {
+	r.SetLogger(l)
+	t := &bodyTransfer{r: r, w: w, done: done,
+		finish: make(chan struct{}), errCh: make(chan error), log: l}
 	go t.start()
 	return t
 }
 
 func (t *bodyTransfer) sendError(err error) {
-	log.Printf("W body transfer is sending error: %v", err)
+	t.log.Warnf("body transfer is sending error: %v", err)
 	select {
 	case <-t.done:
 	case t.errCh <- err:
@@ -88,30 +105,39 @@ func (t *bodyTransfer) sendError(err error) {
 func (t *bodyTransfer) start() {
 	defer close(t.finish)
 	//defer close(t.errCh)
-	log.Println("I transferBody (if any)")
+	t.log.Debugf("transferBody (if any)")
 	t.r.Start()
 	for {
 		select {
 		case b := <-t.r.BodyReceived():
 			if len(b) == 0 {
-				log.Printf("I body received done")
+				t.log.Debugf("body received done")
+				t.complete = true
 				return
 			}
 			n, err := t.w.Write(b)
 			if n != len(b) || err != nil {
-				log.Println("W write failed")
+				t.log.Warnf("write failed: %v", err)
+				if t.err = err; err == nil {
+					t.err = io.ErrShortWrite
+				}
+				metrics.Errors.inc(StageBodyTransfer)
 				t.r.Cancel()
 				return
 			}
 		case err := <-t.r.ErrorOccurred():
 			if err != io.EOF {
-				log.Printf("E read error: %v", err)
+				t.log.Errorf("read error: %v", err)
+				t.err = err
+				metrics.Errors.inc(StageBodyTransfer)
+			} else {
+				t.complete = true
 			}
 			// this allows to close |t.finish| before sending err
 			go t.sendError(err)
 			return
 		case <-t.done:
-			log.Println("I transferBody done")
+			t.log.Debugf("transferBody done")
 			t.r.Cancel()
 			return
 		}
@@ -129,21 +155,64 @@ func (t *bodyTransfer) waitFinish() {
 
 // Worker handles an HTTP request and serves as proxy
 type Worker struct {
-	clientConn         net.Conn
-	serverConn         net.Conn
+	clientConn         *timeoutConn
+	serverConn         *timeoutConn
 	clientReader       *bufio.Reader
 	serverReader       *bufio.Reader
 	clientBodyTransfer *bodyTransfer
 	serverBodyTransfer *bodyTransfer
 	req                *Request
 	res                *Response
+	resBody            []byte    // body of a response made by the proxy itself
+	settings           *Settings // snapshot taken when the worker was created
+	route              *Route    // nil unless sent via an upstream proxy
+	identity           Identity  // empty unless authenticated
+	rateKeys           []bucketKey
+	rateBuckets        []*tokenBucket
+	netProfile         *NetworkProfile    // nil unless emulating a network
+	trace              *requestTrace      // nil unless tracing
+	har                *harCapture        // nil unless recording
+	fixture            *fixtureCapture    // nil unless recording with -record
+	cacheFill          *cacheFill         // nil unless the response may be cached
+	revalidation       *cacheRevalidation // nil unless validating a stale response
+	fetch              *cacheFetch        // nil unless relaying the response to collapsed requests
+	leaderClient       *leaderWriter      // nil unless relaying the body to collapsed requests
+	bodySource         io.Reader          // request body, read before dialing if replaying
+	upload             <-chan struct{}    // closed once the request body is relayed, nil without one
+	times              workerTimes
+	termination        string // see AccessRecord.Termination
+	log                *Logger
+	connID             uint64
+	id                 uint64       // request ID, zero until a request is read
+	bytesIn            atomic.Int64 // body bytes from the client
+	bytesOut           atomic.Int64 // body bytes to the client
+	infoMu             sync.Mutex
+	info               WorkerInfo   // see Info
+	deadline           time.Time    // zero if Timeouts.Total is disabled
+	idle               atomic.Bool  // true while waiting for a request
+	state              atomic.Value // name of the current state function
 	done               chan struct{}
+	doneOnce           sync.Once
 }
 
 type stateFunc func(*Worker) stateFunc
 
+// IDs attached to log lines. Both are unique in the process.
+var nextConnID, nextRequestID atomic.Uint64
+
+// workerTimes records when each phase of a request started. Phases not
+// reached are zero.
+type workerTimes struct {
+	start     time.Time // connection accepted
+	received  time.Time // request header read
+	dialStart time.Time
+	dial      time.Duration
+	sent      time.Time // request header sent upstream
+	responded time.Time // response header received
+}
+
 func NewWorker() *Worker {
-	return &Worker{
+	w := &Worker{
 		clientConn:         nil,
 		serverConn:         nil,
 		clientReader:       nil,
@@ -152,84 +221,722 @@ func NewWorker() *Worker {
 		serverBodyTransfer: nil,
 		req:                nil,
 		res:                nil,
+		settings:           loadSettings(),
 		done:               make(chan struct{}),
 	}
+	w.connID = nextConnID.Add(1)
+	w.log = logger.With("conn", w.connID)
+	return w
 }
 
 func (w *Worker) Start(conn net.Conn) {
-	log.Printf("I worker started")
-	w.clientConn = conn
-	w.clientReader = bufio.NewReader(conn)
+	w.log.Debugf("worker started")
+	w.times.start = time.Now()
+	w.updateInfo(func(i *WorkerInfo) {
+		i.Client = conn.RemoteAddr().String()
+		i.Started = w.times.start
+	})
+	if w.settings.Timeouts.Total > 0 {
+		w.deadline = time.Now().Add(w.settings.Timeouts.Total)
+	}
+	w.clientConn = newTimeoutConn(conn, w.deadline)
+	w.clientConn.setWriteIdle(w.settings.Timeouts.BodyIdle)
+	w.clientReader = bufio.NewReader(w.clientConn)
 
 	for state := waitForRequest; state != nil; {
-		state = state(w)
+		name := stateName(state)
+		w.state.Store(name)
+		metrics.WorkerStates.add(1, name)
+		next := state(w)
+		metrics.WorkerStates.add(-1, name)
+		state = next
 	}
-	log.Printf("I worker finished")
+	w.log.Debugf("worker finished")
 }
 
+// Cancel stops the worker. It is safe to call at any time, even after the
+// worker finished.
 func (w *Worker) Cancel() {
-	w.done <- struct{}{}
+	w.closeDone()
 }
 
-func (w *Worker) dialToServer() error {
+func (w *Worker) closeDone() {
+	w.doneOnce.Do(func() { close(w.done) })
+}
+
+// terminate records why the request ends. The first reason wins.
+func (w *Worker) terminate(reason string) {
+	if w.termination == "" {
+		w.termination = reason
+	}
+}
+
+// WorkerInfo describes a running worker.
+type WorkerInfo struct {
+	ID       uint64    `json:"id"` // connection ID as in logs
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Request  string    `json:"request,omitempty"` // method and URI
+	Upstream string    `json:"upstream,omitempty"`
+	State    string    `json:"state"` // name of the state function
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Started  time.Time `json:"started"`
+	Age      float64   `json:"age_seconds"`
+}
+
+// Info returns a snapshot of the worker. It is safe to call at any time.
+func (w *Worker) Info() WorkerInfo {
+	w.infoMu.Lock()
+	info := w.info
+	w.infoMu.Unlock()
+	info.ID = w.connID
+	info.State, _ = w.state.Load().(string)
+	info.BytesIn = w.bytesIn.Load()
+	info.BytesOut = w.bytesOut.Load()
+	if !info.Started.IsZero() {
+		info.Age = time.Since(info.Started).Seconds()
+	}
+	return info
+}
+
+func (w *Worker) updateInfo(f func(*WorkerInfo)) {
+	w.infoMu.Lock()
+	defer w.infoMu.Unlock()
+	f(&w.info)
+}
+
+func (w *Worker) isIdle() bool {
+	return w.idle.Load()
+}
+
+// serverAddr returns host:port to connect to. It is the request target
+// for CONNECT and the Host header otherwise.
+func (w *Worker) serverAddr() (string, error) {
+	if w.req.Method == "CONNECT" {
+		return appendDefaultPort(w.req.URI, "443"), nil
+	}
 	host, ok := w.req.Headers["host"]
 	if !ok {
-		return fmt.Errorf("Missing host")
+		return "", fmt.Errorf("Missing host")
+	}
+	return appendPortIfNeeded(host), nil
+}
+
+func (w *Worker) dialToServer() error {
+	addr, err := w.serverAddr()
+	if err != nil {
+		return err
+	}
+	timeout := w.settings.Timeouts.Dial
+	if !w.deadline.IsZero() {
+		left := time.Until(w.deadline)
+		if left <= 0 {
+			return fmt.Errorf("Dial to %s: %w", addr, os.ErrDeadlineExceeded)
+		}
+		if timeout == 0 || left < timeout {
+			timeout = left
+		}
+	}
+	var conn net.Conn
+	start := time.Now()
+	w.times.dialStart = start
+	defer func() { w.times.dial = time.Since(start) }()
+	if w.route = w.settings.routeFor(hostWithoutPort(addr)); w.route != nil {
+		// The upstream proxy checks the destination itself.
+		conn, err = serverDialer(w.route.Via, timeout)
+	} else {
+		conn, err = w.settings.Guard.Dial(addr, timeout)
 	}
-	addr := appendPortIfNeeded(host)
-	conn, err := serverDialer(addr)
-	if err == nil {
-		w.serverConn = conn
-		w.serverReader = bufio.NewReader(conn)
+	if err != nil {
+		metrics.Errors.inc(StageDial)
+	} else {
+		metrics.DialSeconds.observe(time.Since(start).Seconds())
+		w.updateInfo(func(i *WorkerInfo) { i.Upstream = conn.RemoteAddr().String() })
+		w.serverConn = newTimeoutConn(conn, w.deadline)
+		w.serverConn.setWriteIdle(w.settings.Timeouts.BodyIdle)
+		w.serverReader = bufio.NewReader(w.serverConn)
 	}
 	return err
 }
 
+// requestURL returns the URL of a request other than CONNECT, completing
+// origin-form targets with the Host header.
+func requestURL(req *Request) string {
+	if strings.HasPrefix(req.URI, "/") {
+		return "http://" + req.Headers["host"] + req.URI
+	}
+	return req.URI
+}
+
+// hostMatchesURI tells if the authority of an absolute-form target names
+// the server of the Host header, the one dialed. Otherwise a response would
+// be cached, recorded or shared under the URL of another server.
+func hostMatchesURI(req *Request) bool {
+	if req.Method == "CONNECT" || strings.HasPrefix(req.URI, "/") {
+		return true
+	}
+	u, err := url.Parse(req.URI)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host, ok := req.Headers["host"]
+	return ok && strings.EqualFold(appendPortIfNeeded(u.Host), appendPortIfNeeded(host))
+}
+
+// destinationHost returns the host name of the request without port.
+func (w *Worker) destinationHost() string {
+	addr, _ := w.serverAddr()
+	return hostWithoutPort(addr)
+}
+
+// checkACL returns false if the request is denied.
+func (w *Worker) checkACL() bool {
+	addr, _ := w.serverAddr()
+	host, ps, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(ps)
+	action, rule := w.settings.ACL.Check(aclRequest{
+		client: net.ParseIP(clientIP(w.clientConn.RemoteAddr())),
+		user:   w.identity.User,
+		groups: w.identity.Groups,
+		host:   host,
+		port:   port,
+		method: w.req.Method,
+	})
+	if action == ACLDeny {
+		w.log.Warnf("acl: %s %s %s from %s (user %q) denied by %s",
+			w.req.Method, w.req.URI, addr, w.clientConn.RemoteAddr(), w.identity.User, rule)
+		return false
+	}
+	return true
+}
+
+// authenticate sets w.identity, or returns false if credentials are
+// missing or wrong.
+func (w *Worker) authenticate() bool {
+	if w.settings.Auth == nil {
+		return true
+	}
+	id, err := w.settings.Auth.Authenticate(w.req.Headers["proxy-authorization"])
+	if err != nil {
+		w.log.Warnf("auth: %s %s from %s: %v",
+			w.req.Method, w.req.URI, w.clientConn.RemoteAddr(), err)
+		return false
+	}
+	w.identity = id
+	w.updateInfo(func(i *WorkerInfo) { i.User = id.User })
+	return true
+}
+
+// bodyWriter wraps |conn| with rate limiting and network emulation.
+func (w *Worker) bodyWriter(conn *timeoutConn) io.Writer {
+	cw := countingWriter{conn, "out", &w.bytesOut}
+	if conn == w.serverConn {
+		cw = countingWriter{conn, "in", &w.bytesIn}
+	}
+	bw := newRateLimitedWriter(cw, w.rateBuckets, w.done)
+	if w.netProfile != nil {
+		bw = newEmulatedWriter(bw, *w.netProfile, w.done, w.resetConns)
+	}
+	writers := []io.Writer{bw}
+	if w.fetch != nil && conn == w.clientConn {
+		w.leaderClient = &leaderWriter{w: bw}
+		writers[0] = w.leaderClient
+	}
+	if w.har != nil && w.har.recorder.bodyLimit > 0 {
+		writers = append(writers, pick(conn == w.serverConn, w.har.reqBody, w.har.resBody))
+	}
+	if w.cacheFill != nil && conn == w.clientConn {
+		writers = append(writers, w.cacheFill.writer(w.res))
+	}
+	if w.fetch != nil && conn == w.clientConn {
+		writers = append(writers, w.fetch)
+	}
+	if w.fixture != nil {
+		writers = append(writers, pick(conn == w.serverConn, w.fixture.reqBody, w.fixture.resBody))
+	}
+	if len(writers) > 1 {
+		return io.MultiWriter(writers...)
+	}
+	return bw
+}
+
+func pick(first bool, a, b io.Writer) io.Writer {
+	if first {
+		return a
+	}
+	return b
+}
+
+func (w *Worker) resetConns() {
+	w.log.Warnf("resetting connections (network emulation)")
+	resetConn(w.clientConn.Conn)
+	if w.serverConn != nil {
+		resetConn(w.serverConn.Conn)
+	}
+}
+
+// sleep waits for |d| unless the worker is canceled first.
+func (w *Worker) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// after returns the deadline for a phase that may last d from now.
+func (w *Worker) after(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
 func (w *Worker) requestReceived(req *Request) stateFunc {
 	w.req = req
+	w.times.received = time.Now()
+	w.id = nextRequestID.Add(1)
+	w.updateInfo(func(i *WorkerInfo) { i.Request = req.Method + " " + req.URI })
+	w.log = w.log.With("req", w.id)
+	if w.settings.debugHost(w.destinationHost()) {
+		w.log = w.log.Traced()
+	}
+	if h := harRecorder; h != nil && req.Method != "CONNECT" && h.records(w.destinationHost()) {
+		w.har = h.newCapture(req)
+	}
+	if spanExporter != nil {
+		w.trace = newRequestTrace(req.Headers)
+	}
 
-	if req.Method != "GET" && req.Method != "HEAD" && req.Method != "POST" {
-		log.Printf("E %s is not supported", req.Method)
+	if req.Method != "GET" && req.Method != "HEAD" && req.Method != "POST" &&
+		req.Method != "CONNECT" {
+		w.log.Errorf("%s is not supported", req.Method)
+		w.terminate(TermBadRequest)
 		w.res = ResponseBadRequest // Should be appropriate response
 		return sendErrorResponse
 	}
 
-	if err := w.dialToServer(); err != nil {
-		log.Println(err)
+	if !hostMatchesURI(req) {
+		w.log.Errorf("%s does not match host %q", req.URI, req.Headers["host"])
+		w.terminate(TermBadRequest)
 		w.res = ResponseBadRequest
 		return sendErrorResponse
 	}
 
-	log.Printf("I %s -> %s",
-		w.clientConn.RemoteAddr().String(),
+	if !w.authenticate() {
+		w.terminate(TermDenied)
+		w.res = proxyAuthRequiredResponse(w.settings.Auth.Challenge())
+		return sendErrorResponse
+	}
+
+	if !w.checkACL() {
+		w.terminate(TermDenied)
+		w.res = ResponseForbidden
+		return sendErrorResponse
+	}
+
+	if host := w.destinationHost(); w.settings.Blocklist.Blocked(host) {
+		w.log.Warnf("blocklist: %s %s from %s blocked",
+			req.Method, host, w.clientConn.RemoteAddr())
+		w.terminate(TermDenied)
+		w.res, w.resBody = w.settings.Blocklist.response(req.Method)
+		return sendErrorResponse
+	}
+
+	if p, ok := networkEmulation.profileFor(
+		clientIP(w.clientConn.RemoteAddr()), w.destinationHost()); ok {
+		w.netProfile = &p
+		if !w.sleep(p.Latency) {
+			return finishWorker
+		}
+	}
+
+	if c := responseCache; c != nil {
+		if next := w.useCache(c); next != nil {
+			return next
+		}
+	}
+
+	w.bodySource = w.clientReader
+	if s := fixtures; s != nil && req.Method != "CONNECT" {
+		if s.mode == FixtureRecord {
+			w.fixture = s.newCapture(req)
+		} else if next := w.replay(s); next != nil {
+			return next
+		}
+	}
+
+	if err := w.dialToServer(); err != nil {
+		w.log.Errorf("%v", err)
+		switch {
+		case errors.Is(err, ErrBlockedDestination):
+			w.terminate(TermDenied)
+			w.res = ResponseForbidden
+		case isTimeout(err):
+			w.terminate(TermDialTimeout)
+			w.res = ResponseGatewayTimeout
+		default:
+			w.terminate(TermDialError)
+			w.res = ResponseBadRequest
+		}
+		return sendErrorResponse
+	}
+
+	w.log.Infof("%s (user %q) -> %s",
+		w.clientConn.RemoteAddr().String(), w.identity.User,
 		w.serverConn.RemoteAddr().String())
-	log.Printf("I %s %v", w.req.URI, w.req.Headers)
+	w.log.Debugf("%s %v", w.req.URI, w.req.Headers)
+
+	w.rateKeys = rateLimits.acquire(
+		clientIP(w.clientConn.RemoteAddr()), w.identity.User, w.destinationHost())
+	w.rateBuckets = rateLimits.bucketsFor(w.rateKeys)
+	if w.netProfile != nil && w.netProfile.BytesPerSec > 0 {
+		w.rateBuckets = append(w.rateBuckets,
+			newTokenBucket(RateLimit{BytesPerSec: w.netProfile.BytesPerSec}))
+	}
+
+	if req.Method == "CONNECT" {
+		if w.route != nil {
+			// The upstream proxy answers the CONNECT itself.
+			RemoveHopByHopHeaders(w.req.Headers)
+			WriteRequest(w.serverConn, req)
+			return w.startTunnel(false)
+		}
+		return w.startTunnel(true)
+	}
 
 	RemoveHopByHopHeaders(w.req.Headers)
 	WriteRequest(w.serverConn, req)
+	w.times.sent = time.Now()
 
-	br := createBodyReader(w.clientReader, w.req.Headers)
+	br := createBodyReader(w.bodySource, w.req.Headers)
+	uploading := br != nil
 	if br == nil {
-		log.Printf("I no request body")
+		w.log.Debugf("no request body")
+		w.serverConn.setReadDeadline(w.after(w.settings.Timeouts.FirstByte))
+		// The watcher may legitimately block until the response is done.
+		w.clientConn.setReadDeadline(time.Time{})
 		br = NewClientConnectionWatcher(w.clientReader)
+	} else {
+		w.clientConn.setReadIdle(w.settings.Timeouts.BodyIdle)
+	}
+	w.clientBodyTransfer = newBodyTransfer(br, w.bodyWriter(w.serverConn), w.done, w.log)
+	if uploading {
+		// The first byte is waited for once the body is relayed.
+		w.upload = w.clientBodyTransfer.finish
 	}
-	w.clientBodyTransfer = newBodyTransfer(br, w.serverConn, w.done)
 
 	return waitForResponse
 }
 
+// useCache serves GET and HEAD requests from |c| when it has a usable
+// response. It returns nil to forward the request.
+func (w *Worker) useCache(c *Cache) stateFunc {
+	if w.req.Method != "GET" && w.req.Method != "HEAD" {
+		return nil
+	}
+	now := time.Now()
+	e, result := c.lookup(w.req, now)
+	metrics.CacheLookups.inc(result)
+	w.log.Debugf("cache: %s %s", result, requestURL(w.req))
+	switch {
+	case result == CacheHit:
+		if next := w.serveFromCache(e, now); next != nil {
+			return next
+		}
+	case requestCacheControl(w.req.Headers).has("only-if-cached"):
+		w.terminate(TermCacheMiss)
+		w.res = ResponseGatewayTimeout
+		return sendErrorResponse
+	}
+	if result == CacheStale {
+		r, err := c.revalidate(w.req, e)
+		if err != nil {
+			w.log.Warnf("cache: %v", err)
+		}
+		w.revalidation = r
+	}
+	if w.revalidation == nil && collapsible(w.req) {
+		if next := w.collapse(c); next != nil {
+			return next
+		}
+	}
+	if w.req.Method == "GET" {
+		w.cacheFill = c.newFill(w.req)
+	}
+	if r := w.revalidation; r != nil {
+		r.setConditions(w.req.Headers)
+	}
+	return nil
+}
+
+// collapse joins the fetch of the same URL by another worker, or starts
+// one. It returns nil to forward the request.
+func (w *Worker) collapse(c *Cache) stateFunc {
+	for i := 0; i < maxCollapseTries; i++ {
+		f, leader := c.joinFetch(w.req)
+		if leader {
+			w.fetch = f
+			return nil
+		}
+		next, retry := w.follow(f)
+		if !retry {
+			return next
+		}
+		w.log.Debugf("cache: collapsed fetch of %s failed, retrying", f.key)
+	}
+	return nil
+}
+
+// follow relays the response fetched by another worker. It returns nil to
+// forward the request, with |retry| true if the fetch failed before its
+// response.
+func (w *Worker) follow(f *cacheFetch) (next stateFunc, retry bool) {
+	defer f.release()
+	select {
+	case <-f.ready:
+	case <-w.done:
+		return finishWorker, false
+	}
+	res, retry := f.response()
+	if res == nil || !f.sameVariant(w.req) {
+		return nil, retry
+	}
+	w.log.Debugf("cache: collapsed into fetch of %s", f.key)
+	w.times.sent = time.Now()
+	w.times.responded = w.times.sent
+	w.res = res
+	WriteResponse(w.clientConn, w.res)
+	if _, err := io.Copy(w.bodyWriter(w.clientConn), f.newReader(w.done)); err != nil {
+		select {
+		case <-w.done:
+		default:
+			w.log.Warnf("cache: relaying collapsed response: %v", err)
+			if errors.Is(err, errFetchFailed) {
+				w.terminate(TermUpstreamError)
+			} else {
+				w.terminate(TermClientClosed)
+			}
+		}
+	}
+	return finishWorker, false
+}
+
+// serveFromCache sends |e|. It returns nil if the body can't be read.
+func (w *Worker) serveFromCache(e *cacheEntry, now time.Time) stateFunc {
+	var body io.ReadSeekCloser
+	if w.req.Method != "HEAD" && !notModified(w.req.Headers, e.res) {
+		var err error
+		if body, err = e.openBody(); err != nil {
+			w.log.Warnf("cache: %v", err)
+			return nil
+		}
+		defer body.Close()
+	}
+	w.times.sent = now
+	w.times.responded = now
+	w.sendCached(e.response(now), w.req.Headers, body)
+	return finishWorker
+}
+
+// sendCached sends |res| with |body| to a request with the headers |h|,
+// a 304 response if its conditions are false, or the ranges it asks for.
+func (w *Worker) sendCached(res *Response, h HTTPHeader, body io.ReadSeeker) {
+	var err error
+	if notModified(h, res) {
+		w.res = notModifiedResponse(res)
+		WriteResponse(w.clientConn, w.res)
+	} else if r := newRangeResponse(h, res); r != nil && body != nil {
+		w.res = r.res
+		WriteResponse(w.clientConn, w.res)
+		err = r.writeBody(w.bodyWriter(w.clientConn), body)
+	} else {
+		w.res = res
+		WriteResponse(w.clientConn, w.res)
+		if body != nil {
+			_, err = io.Copy(w.bodyWriter(w.clientConn), body)
+		}
+	}
+	if err != nil {
+		w.log.Warnf("cache: writing response body: %v", err)
+		w.terminate(TermClientClosed)
+	}
+}
+
+// revalidated serves the stale response |r| once the server answered 304
+// Not Modified.
+func (w *Worker) revalidated(r *cacheRevalidation, res *Response) stateFunc {
+	if w.cacheFill != nil {
+		w.cacheFill.body.discard()
+		w.cacheFill = nil
+	}
+	e := responseCache.freshen(r, res, w.times.sent, w.times.responded)
+	if e == nil {
+		w.log.Errorf("cache: 304 response for another representation of %s", requestURL(r.req))
+		w.terminate(TermUpstreamError)
+		w.res = ResponseBadGateway
+		return sendErrorResponse
+	}
+	w.log.Debugf("cache: revalidated %s", requestURL(r.req))
+	out := e.response(w.times.responded)
+	out.Headers["cache-status"] = "proxy; fwd=stale; fwd-status=304"
+	w.sendCached(out, r.req.Headers, r.body)
+	return finishWorker
+}
+
+// updateCache stores a relayed response, or invalidates the URL after a
+// successful POST as RFC 9111 section 4.4 requires.
+func (w *Worker) updateCache(c *Cache) {
+	switch {
+	case w.cacheFill != nil && w.termination != TermComplete:
+		w.cacheFill.body.discard()
+	case w.cacheFill != nil:
+		if w.cacheFill.store(w.res, w.times.sent, w.times.responded) {
+			w.log.Debugf("cache: stored %s", requestURL(w.req))
+		}
+	case w.req.Method == "POST" && w.res.Status < 400:
+		c.invalidate(requestURL(w.req))
+	}
+}
+
+// readRequestBody reads the whole request body, as received with any
+// chunked framing.
+func (w *Worker) readRequestBody() ([]byte, error) {
+	br := createBodyReader(w.clientReader, w.req.Headers)
+	if br == nil {
+		return nil, nil
+	}
+	w.clientConn.setReadIdle(w.settings.Timeouts.BodyIdle)
+	c := &bodyCapture{limit: fixtureBodyLimit}
+	t := newBodyTransfer(br, c, w.done, w.log)
+	t.waitFinish()
+	select {
+	case <-w.done:
+		return nil, fmt.Errorf("Canceled reading request body")
+	default:
+	}
+	if t.err != nil {
+		return nil, t.err
+	}
+	b, complete := c.bytes()
+	if !complete {
+		return nil, errBodyTooLarge
+	}
+	return b, nil
+}
+
+// replay answers the request from |s|. It returns nil to send a request
+// not recorded to the server, with the body already read.
+func (w *Worker) replay(s *FixtureStore) stateFunc {
+	body, err := w.readRequestBody()
+	if err != nil {
+		w.log.Errorf("replay: reading request body: %v", err)
+		switch {
+		case errors.Is(err, errBodyTooLarge):
+			w.terminate(TermRequestTooLarge)
+			w.res = ResponseContentTooLarge
+		case isTimeout(err):
+			w.terminate(TermRequestTimeout)
+			w.res = ResponseRequestTimeout
+		default:
+			w.terminate(TermClientClosed)
+			return finishWorker
+		}
+		return sendErrorResponse
+	}
+	r := s.request(w.req, body)
+	f, err := s.Load(r)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			w.log.Errorf("replay: %v", err)
+		}
+		if s.passMisses {
+			w.log.Infof("replay: no recorded response for %s %s, passing through", r.Method, r.URL)
+			w.bodySource = bytes.NewReader(body)
+			return nil
+		}
+		w.log.Errorf("replay: no recorded response for %s %s", r.Method, r.URL)
+		w.bytesIn.Add(int64(len(body)))
+		w.terminate(TermReplayMiss)
+		w.res, w.resBody = replayMissResponse(r.Method, r.URL)
+		return sendErrorResponse
+	}
+
+	w.log.Infof("replay: %s %s -> %d", r.Method, r.URL, f.Status)
+	w.bytesIn.Add(int64(len(body)))
+	w.times.sent = time.Now()
+	w.times.responded = w.times.sent
+	w.res = &Response{f.Version, f.Status, f.Phrase, f.Headers}
+	WriteResponse(w.clientConn, w.res)
+	if _, err := w.bodyWriter(w.clientConn).Write(f.Body); err != nil {
+		w.log.Warnf("replay: writing response body: %v", err)
+		w.terminate(TermClientClosed)
+	}
+	return finishWorker
+}
+
+// startTunnel relays bytes in both directions after a successful CONNECT.
+// If |established| is false the response is left to the upstream proxy.
+func (w *Worker) startTunnel(established bool) stateFunc {
+	w.times.sent = time.Now()
+	w.times.responded = w.times.sent
+	if established {
+		w.res = ResponseConnectionEstablished
+		WriteResponse(w.clientConn, w.res)
+	}
+	w.clientConn.setReadIdle(w.settings.Timeouts.BodyIdle)
+	w.serverConn.setReadIdle(w.settings.Timeouts.BodyIdle)
+	w.clientBodyTransfer = newBodyTransfer(
+		NewStreamBodyReader(w.clientReader), w.bodyWriter(w.serverConn), w.done, w.log)
+	w.serverBodyTransfer = newBodyTransfer(
+		NewStreamBodyReader(w.serverReader), w.bodyWriter(w.clientConn), w.done, w.log)
+	return tunnel
+}
+
 func (w *Worker) responseReceived(res *Response) stateFunc {
 	w.res = res
-	log.Printf("I response: %d %v", w.res.Status, w.res.Headers)
+	w.times.responded = time.Now()
+	metrics.FirstByteSeconds.observe(w.times.responded.Sub(w.times.sent).Seconds())
+	w.log.Debugf("response: %d %v", w.res.Status, w.res.Headers)
+
+	if r := w.revalidation; r != nil && res.Status == 304 {
+		return w.revalidated(r, res)
+	}
+	if f := w.fetch; f != nil {
+		if f.cache.shareable(f.req, res) {
+			f.publish(res)
+		} else {
+			f.publish(nil)
+		}
+	}
 
 	// TODO: call RemoveHopByHopHeaders()
+	w.serverConn.setReadIdle(w.settings.Timeouts.BodyIdle)
 	WriteResponse(w.clientConn, res)
 
 	br := createBodyReader(w.serverReader, w.res.Headers)
 	if br == nil {
-		log.Printf("I no response body")
+		w.log.Debugf("no response body")
+		if w.fetch != nil {
+			w.fetch.end(true)
+		}
 	} else {
-		w.serverBodyTransfer = newBodyTransfer(br, w.clientConn, w.done)
+		w.serverBodyTransfer = newBodyTransfer(br, w.bodyWriter(w.clientConn), w.done, w.log)
+		if f := w.fetch; f != nil {
+			// Collapsed requests need not wait for the client to close.
+			t := w.serverBodyTransfer
+			go func() {
+				t.waitFinish()
+				f.end(t.complete)
+			}()
+		}
 	}
 
 	return receiveBody
@@ -238,19 +945,42 @@ func (w *Worker) responseReceived(res *Response) stateFunc {
 // state funcs
 
 func waitForRequest(w *Worker) stateFunc {
-	log.Printf("I waiting request\n")
+	w.log.Debugf("waiting request")
+	w.clientConn.setReadDeadline(w.after(w.settings.Timeouts.ClientHeader))
 	r := NewRequestReader(w.clientReader)
+	r.limits = w.settings.HeaderLimits
 	r.Start()
+	w.idle.Store(true)
 	for {
 		select {
 		case req := <-r.RequestReceived():
+			w.idle.Store(false)
 			return w.requestReceived(req)
 		case err := <-r.ErrorOccurred():
-			log.Println(err)
-			w.res = ResponseInternalError
+			w.log.Errorf("%v", err)
+			if !errors.Is(err, io.EOF) {
+				metrics.Errors.inc(StageRequestRead)
+			}
+			switch {
+			case errors.Is(err, ErrLineTooLong):
+				w.terminate(TermRequestTooLarge)
+				w.res = ResponseURITooLong
+			case isHeaderLimitError(err):
+				w.terminate(TermRequestTooLarge)
+				w.res = ResponseHeaderFieldsTooLarge
+			case isTimeout(err):
+				w.terminate(TermRequestTimeout)
+				w.res = ResponseRequestTimeout
+			case errors.Is(err, io.EOF):
+				w.terminate(TermClientClosed)
+				w.res = ResponseInternalError
+			default:
+				w.terminate(TermBadRequest)
+				w.res = ResponseInternalError
+			}
 			return sendErrorResponse
 		case <-w.done:
-			log.Println("W waitForRequest done")
+			w.log.Warnf("waitForRequest done")
 			return finishWorker
 		}
 	}
@@ -258,22 +988,46 @@ func waitForRequest(w *Worker) stateFunc {
 }
 
 func waitForResponse(w *Worker) stateFunc {
-	log.Printf("I waiting response\n")
+	w.log.Debugf("waiting response")
 	r := NewResponseReader(w.serverReader)
+	r.limits = w.settings.HeaderLimits
 	r.Start()
+	upload := w.upload
 	for {
 		select {
+		case <-upload:
+			upload = nil
+			if w.clientBodyTransfer.complete {
+				w.serverConn.armReadDeadline(w.after(w.settings.Timeouts.FirstByte))
+			}
 		case res := <-r.ResponseReceived():
 			return w.responseReceived(res)
 		case err := <-r.ErrorOccurred():
-			log.Println(err)
-			w.res = ResponseInternalError
+			w.log.Errorf("%v", err)
+			metrics.Errors.inc(StageResponseRead)
+			switch {
+			case isHeaderLimitError(err):
+				w.terminate(TermUpstreamError)
+				w.res = ResponseBadGateway
+			case isTimeout(err):
+				w.terminate(TermUpstreamTimeout)
+				w.res = ResponseGatewayTimeout
+			default:
+				w.terminate(TermUpstreamError)
+				w.res = ResponseInternalError
+			}
 			return sendErrorResponse
 		case err := <-w.clientBodyTransfer.errorOccurred():
-			log.Printf("E client connection has an error: %v", err)
+			w.log.Errorf("client connection has an error: %v", err)
+			if isTimeout(err) {
+				w.terminate(TermRequestTimeout)
+				w.res = ResponseRequestTimeout
+				return sendErrorResponse
+			}
+			w.terminate(TermClientClosed)
 			return finishWorker
 		case <-w.done:
-			log.Println("W waitForResponse done")
+			w.log.Warnf("waitForResponse done")
 			return finishWorker
 		}
 	}
@@ -285,25 +1039,193 @@ func receiveBody(w *Worker) stateFunc {
 	w.clientBodyTransfer.waitFinish()
 	if w.serverBodyTransfer != nil {
 		w.serverBodyTransfer.waitFinish()
+		if err := w.serverBodyTransfer.err; err != nil {
+			w.terminate(TermUpstreamError)
+		} else if l := w.leaderClient; l != nil && l.err != nil {
+			w.log.Errorf("client connection has an error: %v", l.err)
+			w.terminate(TermClientClosed)
+		}
+	}
+	return finishWorker
+}
+
+// tunnel ends as soon as either side closes.
+func tunnel(w *Worker) stateFunc {
+	select {
+	case <-w.clientBodyTransfer.finish:
+		w.terminate(TermClientClosed)
+	case <-w.serverBodyTransfer.finish:
+		w.terminate(TermUpstreamClosed)
+	case <-w.done:
 	}
 	return finishWorker
 }
 
 func sendErrorResponse(w *Worker) stateFunc {
-	log.Printf("E sending error response: %v", w.res)
+	w.log.Errorf("sending error response: %d %s", w.res.Status, w.res.Phrase)
 	WriteResponse(w.clientConn, w.res)
+	if w.req != nil && w.req.Method == "HEAD" {
+		// Content-Length tells the size of the body a GET would get.
+		w.resBody = nil
+	}
+	if len(w.resBody) > 0 {
+		w.clientConn.Write(w.resBody)
+	}
 	return finishWorker
 }
 
 func finishWorker(w *Worker) stateFunc {
 	if w.clientConn != nil {
-		log.Printf("I client conn closing")
+		w.log.Debugf("client conn closing")
 		w.clientConn.Close()
 	}
 	if w.serverConn != nil {
-		log.Printf("I server conn closing")
+		w.log.Debugf("server conn closing")
 		w.serverConn.Close()
 	}
-	close(w.done)
+	rateLimits.release(w.rateKeys)
+	select {
+	case <-w.done:
+		w.terminate(TermCanceled)
+	default:
+		w.terminate(TermComplete)
+	}
+	w.closeDone()
+	if w.req != nil {
+		status := "none"
+		if w.res != nil {
+			status = strconv.Itoa(w.res.Status)
+		}
+		metrics.Requests.inc(methodLabel(w.req.Method), status)
+	}
+	if w.req != nil || w.termination != TermClientClosed {
+		accessLog.Write(w.accessRecord())
+	}
+	if w.req != nil && responseCache != nil && w.res != nil && !w.times.responded.IsZero() {
+		w.updateCache(responseCache)
+	}
+	if r := w.revalidation; r != nil && r.body != nil {
+		r.body.Close()
+	}
+	if w.fetch != nil {
+		w.fetch.cache.endFetch(w.fetch)
+	}
+	if w.fixture != nil && w.termination == TermComplete && !w.times.responded.IsZero() {
+		if err := w.fixture.save(w.res); err != nil {
+			w.log.Errorf("record: %v", err)
+		}
+	}
+	if w.har != nil {
+		if err := w.har.recorder.Add(w.harEntry()); err != nil {
+			w.log.Errorf("har: %v", err)
+		}
+	}
+	if w.trace != nil && w.trace.sampled() {
+		spanExporter.Export(w.spans()...)
+	}
 	return nil
 }
+
+func (w *Worker) accessRecord() *AccessRecord {
+	end := time.Now()
+	t := w.times
+	r := &AccessRecord{
+		ID:          w.id,
+		Time:        t.received,
+		Client:      w.clientConn.RemoteAddr().String(),
+		User:        w.identity.User,
+		Termination: w.termination,
+		Dial:        t.dial,
+		Total:       end.Sub(t.start),
+		BytesOut:    int64(len(w.resBody)),
+	}
+	if r.Time.IsZero() {
+		r.Time = t.start
+	} else {
+		r.Header = t.received.Sub(t.start)
+	}
+	if w.req != nil {
+		r.Method, r.URI, r.Version = w.req.Method, w.req.URI, w.req.Version
+		r.Referer = w.req.Headers["referer"]
+		r.UserAgent = w.req.Headers["user-agent"]
+	}
+	if w.serverConn != nil {
+		r.Upstream = w.serverConn.RemoteAddr().String()
+	}
+	if w.res != nil {
+		r.Status = w.res.Status
+	}
+	if !t.responded.IsZero() {
+		r.FirstByte = t.responded.Sub(t.sent)
+		r.Transfer = end.Sub(t.responded)
+	}
+	r.BytesIn = w.bytesIn.Load()
+	r.BytesOut += w.bytesOut.Load()
+	return r
+}
+
+// spans returns the span of the request and its children for the dial,
+// the upstream exchange up to the response header and the response body
+// or tunnel.
+func (w *Worker) spans() []*Span {
+	end := time.Now()
+	t := w.times
+	tr := w.trace
+	span := func(id, parent [8]byte, name string, kind SpanKind, start, end time.Time) *Span {
+		return &Span{TraceID: tr.TraceID, SpanID: id, ParentID: parent,
+			Name: name, Kind: kind, Start: start, End: end}
+	}
+
+	server := span(tr.server, tr.SpanID, w.req.Method, SpanKindServer, t.start, end)
+	server.Attributes = []SpanAttribute{
+		{"http.request.method", w.req.Method},
+		{"url.full", w.req.URI},
+		{"server.address", w.destinationHost()},
+		{"client.address", clientIP(w.clientConn.RemoteAddr())},
+		{"proxy.termination", w.termination},
+		{"proxy.bytes_in", w.bytesIn.Load()},
+		{"proxy.bytes_out", w.bytesOut.Load()},
+	}
+	if w.identity.User != "" {
+		server.Attributes = append(server.Attributes, SpanAttribute{"enduser.id", w.identity.User})
+	}
+	if w.res != nil {
+		server.Attributes = append(server.Attributes,
+			SpanAttribute{"http.response.status_code", w.res.Status})
+	}
+	if failedTerminations[w.termination] {
+		server.Error = w.termination
+	}
+	spans := []*Span{server}
+
+	if !t.dialStart.IsZero() {
+		dial := span(newSpanID(), tr.server, "dial", SpanKindInternal,
+			t.dialStart, t.dialStart.Add(t.dial))
+		if w.serverConn != nil {
+			dial.Attributes = []SpanAttribute{
+				{"network.peer.address", w.serverConn.RemoteAddr().String()}}
+		} else {
+			dial.Error = w.termination
+		}
+		spans = append(spans, dial)
+	}
+	if !t.sent.IsZero() {
+		if w.req.Method == "CONNECT" {
+			return append(spans, span(tr.forward, tr.server, "tunnel", SpanKindClient, t.sent, end))
+		}
+		responded := t.responded
+		if responded.IsZero() {
+			responded = end
+		}
+		forward := span(tr.forward, tr.server, "forward request", SpanKindClient, t.sent, responded)
+		if t.responded.IsZero() {
+			forward.Error = w.termination
+		}
+		spans = append(spans, forward)
+	}
+	if !t.responded.IsZero() {
+		spans = append(spans, span(newSpanID(), tr.server, "stream response", SpanKindInternal,
+			t.responded, end))
+	}
+	return spans
+}
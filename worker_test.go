@@ -52,7 +52,7 @@ func prepareMocks() (*MockConn, *MockConn) {
 		new(bytes.Buffer),
 		MockAddr{"(server)"},
 	}
-	serverDialer = func(addr string) (net.Conn, error) {
+	serverDialer = func(addr string, timeout time.Duration) (net.Conn, error) {
 		return sConn, nil
 	}
 